@@ -1,6 +1,12 @@
 package mu
 
 import (
+	"container/heap"
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -8,117 +14,1181 @@ import (
 const defaultCap = 100
 const defaultTTL = 5 * time.Minute
 
+// NoExpiration may be passed as a TTL for entries that should never expire.
+const NoExpiration time.Duration = -1
+
+// ErrNotFound is the error stored by AddNegative when it is given a nil error.
+var ErrNotFound = errors.New("not found")
+
 type Cache[K comparable, V any] struct {
 	lock      sync.Mutex
 	cache     map[K]*entry[K, V]
+	policy    EvictionPolicy[K]
+	tick      uint64 // incremented on every write or read hit, see entry.lastUse
 	ttl       time.Duration
 	cap       int
 	keepAlive bool
+	calls     map[K]*call[V]
+	batches   map[*batchLoad[K]]struct{} // in-flight GetManyOrLoad calls
+	onEvict   func(key K, val V, reason EvictReason)
+	evicted   []eviction[K, V] // pending onEvict calls, run by unlock
+	stats     CacheStats
+	stopSweep chan struct{}
+	sweepDone chan struct{}
+	clock     Clock
+
+	refreshAfter time.Duration
+	refresh      func(ctx context.Context, key K) (V, error)
+
+	weigher func(key K, val V) int64
+	maxCost int64
+	cost    int64 // total cost of all entries
+
+	negativeTTL time.Duration
+
+	tags map[string]map[K]struct{} // keys of entries added with each tag
+
+	expiry expiryHeap[K, V] // entries that can expire, soonest first
+
+	jitter         time.Duration
+	jitterFraction float64
+}
+
+// Clock is the source of the current time for a Cache. *Time satisfies it,
+// which lets tests control expiry with Set and Advance.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// CacheStats is a snapshot of a cache's activity since creation or the last
+// ResetStats.
+type CacheStats struct {
+	Hits        uint64 // including reads of negative entries
+	Misses      uint64
+	Expirations uint64 // entries dropped because their TTL elapsed
+	Evictions   uint64 // entries dropped to stay within capacity
+	Size        int    // current number of entries, including any not yet reclaimed after expiring
+	Cost        int64  // total cost of current entries, see Cache.MaxCost
 }
 
 type entry[K comparable, V any] struct {
+	key        K
 	value      V
-	expiration time.Time
+	expiration time.Time // zero if the entry never expires
+	ttl        time.Duration
+	updated    time.Time // when the value was last set, for refresh-ahead
+	cost       int64
+	lastUse    uint64 // value of Cache.tick when last written or read
+	err        error  // set for negative entries, see AddNegative
+	tags       []string
+	heapIndex  int // position in Cache.expiry, or -1 if not there
+}
+
+func (e *entry[K, V]) expired(now time.Time) bool {
+	return !e.expiration.IsZero() && e.expiration.Before(now)
+}
+
+type expiryHeap[K comparable, V any] []*entry[K, V]
+
+func (h expiryHeap[K, V]) Len() int { return len(h) }
+
+func (h expiryHeap[K, V]) Less(i, j int) bool {
+	return h[i].expiration.Before(h[j].expiration)
+}
+
+func (h expiryHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *expiryHeap[K, V]) Push(x any) {
+	ent := x.(*entry[K, V])
+	ent.heapIndex = len(*h)
+	*h = append(*h, ent)
+}
+
+func (h *expiryHeap[K, V]) Pop() any {
+	old := *h
+	ent := old[len(old)-1]
+	old[len(old)-1] = nil
+	ent.heapIndex = -1
+	*h = old[:len(old)-1]
+	return ent
+}
+
+// EvictReason describes why an entry left the cache.
+type EvictReason int
+
+const (
+	EvictCapacity EvictReason = iota // removed to make room for a new entry
+	EvictExpired                     // TTL elapsed
+	EvictRemoved                     // explicit Remove
+	EvictCleared                     // Clear
+	EvictReplaced                    // value overwritten by Add
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictExpired:
+		return "expired"
+	case EvictRemoved:
+		return "removed"
+	case EvictCleared:
+		return "cleared"
+	case EvictReplaced:
+		return "replaced"
+	}
+	return "unknown"
+}
+
+type eviction[K comparable, V any] struct {
+	key    K
+	value  V
+	reason EvictReason
+}
+
+// call is an in-flight GetOrLoad loader shared by all callers waiting on the
+// same key.
+type call[V any] struct {
+	done    chan struct{}
+	val     V
+	err     error
+	panic   any // recovered from load, to be raised again in each waiter
+	waiters int
+	cancel  context.CancelFunc
+	refresh bool   // started by refresh-ahead rather than GetOrLoad
+	gen     uint64 // bumped when the key is invalidated, so the result isn't cached
+}
+
+// batchLoad is an in-flight GetManyOrLoad, which records the keys invalidated
+// while it runs so that their results aren't cached.
+type batchLoad[K comparable] struct {
+	keys        []K
+	invalidated map[K]struct{}
+	cleared     bool
+}
+
+func (b *batchLoad[K]) valid(key K) bool {
+	_, invalidated := b.invalidated[key]
+	return !b.cleared && !invalidated
 }
 
 func NewCache[K comparable, V any]() *Cache[K, V] {
 	return &Cache[K, V]{
-		cache: make(map[K]*entry[K, V], defaultCap),
-		ttl:   defaultTTL,
-		cap:   defaultCap,
+		cache:   make(map[K]*entry[K, V], defaultCap),
+		policy:  NewLRUPolicy[K](),
+		calls:   make(map[K]*call[V]),
+		batches: make(map[*batchLoad[K]]struct{}),
+		tags:    make(map[string]map[K]struct{}),
+		clock:   systemClock{},
+		ttl:     defaultTTL,
+		cap:     defaultCap,
 	}
 }
 
+// Policy sets the eviction policy used when the cache is full. The default is
+// NewLRUPolicy. Each cache needs its own policy instance.
+func (c *Cache[K, V]) Policy(policy EvictionPolicy[K]) *Cache[K, V] {
+	c.lock.Lock()
+	defer c.unlock()
+
+	// Hand over any existing entries in their current recency order
+	for _, ent := range c.entriesByUse() {
+		policy.Added(ent.key)
+	}
+	c.policy = policy
+
+	return c
+}
+
 func (c *Cache[K, V]) Cap(cap int) *Cache[K, V] {
 	c.cap = cap
 	return c
 }
 
+// MaxCost bounds the cache by the total cost of its entries instead of their
+// number; Cap is ignored once a positive MaxCost is set. Each entry's cost
+// comes from the Weigher, or is 1 if there is none. An entry whose cost alone
+// exceeds maxCost is not stored.
+func (c *Cache[K, V]) MaxCost(maxCost int64) *Cache[K, V] {
+	c.maxCost = maxCost
+	return c
+}
+
+// Weigher sets the function used to compute an entry's cost for MaxCost, e.g.
+// its approximate size in bytes.
+func (c *Cache[K, V]) Weigher(weigher func(key K, val V) int64) *Cache[K, V] {
+	c.weigher = weigher
+	return c
+}
+
 func (c *Cache[K, V]) TTL(ttl time.Duration) *Cache[K, V] {
 	c.ttl = ttl
 	return c
 }
 
+// Jitter shortens each entry's lifetime by a random amount of up to max, so
+// that entries added together don't all expire at the same moment. If a
+// JitterFraction is also set, max caps the jitter it produces.
+func (c *Cache[K, V]) Jitter(max time.Duration) *Cache[K, V] {
+	c.jitter = max
+	return c
+}
+
+// JitterFraction is like Jitter but bounds the random amount as a fraction of
+// each entry's TTL, e.g. 0.1 for up to 10%.
+func (c *Cache[K, V]) JitterFraction(fraction float64) *Cache[K, V] {
+	c.jitterFraction = fraction
+	return c
+}
+
+// jitterFor returns a random amount to take off an entry's ttl.
+func (c *Cache[K, V]) jitterFor(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return 0
+	}
+
+	limit := c.jitter
+	if c.jitterFraction > 0 {
+		fromFraction := time.Duration(float64(ttl) * c.jitterFraction)
+		if limit <= 0 || fromFraction < limit {
+			limit = fromFraction
+		}
+	}
+	if limit <= 0 {
+		return 0
+	}
+	if limit > ttl {
+		limit = ttl
+	}
+
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// RefreshAfter enables refresh-ahead: once an entry is older than age, Get
+// still returns it but also starts a background call to refresh to replace
+// it. Only one refresh runs per key at a time, and if it fails the stale
+// value is kept until it expires normally. age should be shorter than the TTL.
+func (c *Cache[K, V]) RefreshAfter(age time.Duration, refresh func(ctx context.Context, key K) (V, error)) *Cache[K, V] {
+	c.refreshAfter = age
+	c.refresh = refresh
+	return c
+}
+
+// NegativeTTL enables caching of GetOrLoad failures: errors returned by the
+// loader (other than context cancellation) are stored as negative entries for
+// ttl, see AddNegative. It also sets the lifetime of entries added with
+// AddNegative, which otherwise use the cache's TTL.
+func (c *Cache[K, V]) NegativeTTL(ttl time.Duration) *Cache[K, V] {
+	c.negativeTTL = ttl
+	return c
+}
+
+func (c *Cache[K, V]) Clock(clock Clock) *Cache[K, V] {
+	c.clock = clock
+	return c
+}
+
 func (c *Cache[K, V]) KeepAlive(keepAlive bool) *Cache[K, V] {
 	c.keepAlive = keepAlive
 	return c
 }
 
+// OnEvict registers a function that is called whenever an entry leaves the
+// cache, e.g. to release resources held by the value. It is called outside of
+// the cache lock, so it may safely use the cache.
+func (c *Cache[K, V]) OnEvict(fn func(key K, val V, reason EvictReason)) *Cache[K, V] {
+	c.onEvict = fn
+	return c
+}
+
+// Janitor starts a background goroutine that removes expired entries every
+// interval, so that entries which are never read again don't hold memory until
+// the cache fills up. Use Close to stop it. An interval of zero or less
+// stops a running janitor instead of starting one.
+func (c *Cache[K, V]) Janitor(interval time.Duration) *Cache[K, V] {
+	if interval <= 0 {
+		c.Close()
+		return c
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go c.sweep(interval, stop, done)
+
+	c.lock.Lock()
+	oldStop, oldDone := c.stopSweep, c.sweepDone
+	c.stopSweep, c.sweepDone = stop, done
+	c.unlock()
+
+	stopSweep(oldStop, oldDone)
+
+	return c
+}
+
+// Close stops the background janitor, if one is running, and waits for it to
+// exit. The cache remains usable afterwards.
+func (c *Cache[K, V]) Close() {
+	c.lock.Lock()
+	stop, done := c.stopSweep, c.sweepDone
+	c.stopSweep, c.sweepDone = nil, nil
+	c.unlock()
+
+	stopSweep(stop, done)
+}
+
+// stopSweep stops a janitor. It must be called without the cache lock, which
+// the janitor may be waiting for.
+func stopSweep(stop, done chan struct{}) {
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (c *Cache[K, V]) sweep(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.lock.Lock()
+			c.purgeExpired()
+			c.unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
 func (c *Cache[K, V]) Remove(key K) {
 	c.lock.Lock()
-	defer c.lock.Unlock()
-	delete(c.cache, key)
+	defer c.unlock()
+
+	if ent, ok := c.cache[key]; ok {
+		c.removeEntry(ent, EvictRemoved)
+	}
+	c.invalidateLoads(key)
+}
+
+// invalidateLoads stops in-flight loads, refreshes and batch loads of key from
+// caching their results, which may predate the invalidation. Later callers
+// start a new load.
+func (c *Cache[K, V]) invalidateLoads(key K) {
+	if cl, ok := c.calls[key]; ok {
+		cl.gen++
+		delete(c.calls, key)
+	}
+	for b := range c.batches {
+		b.invalidated[key] = struct{}{}
+	}
 }
 
 func (c *Cache[K, V]) Clear() {
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	defer c.unlock()
+
+	if c.onEvict != nil {
+		for _, ent := range c.cache {
+			if ent.err == nil {
+				c.evicted = append(c.evicted, eviction[K, V]{ent.key, ent.value, EvictCleared})
+			}
+		}
+	}
 	clear(c.cache)
+	clear(c.tags)
+	c.expiry = nil
+	c.policy.Clear()
+	c.cost = 0
+	for key := range c.calls {
+		c.invalidateLoads(key)
+	}
+	for b := range c.batches {
+		b.cleared = true
+	}
 }
 
-func (c *Cache[K, V]) ensureCapacity() {
-	if len(c.cache) < c.cap {
-		return
+func (c *Cache[K, V]) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.unlock()
+
+	stats := c.stats
+	stats.Size = len(c.cache)
+	stats.Cost = c.cost
+	return stats
+}
+
+func (c *Cache[K, V]) ResetStats() {
+	c.lock.Lock()
+	defer c.unlock()
+	c.stats = CacheStats{}
+}
+
+// unlock releases the cache lock and then runs any onEvict callbacks queued
+// while it was held.
+func (c *Cache[K, V]) unlock() {
+	evicted := c.evicted
+	c.evicted = nil
+	c.lock.Unlock()
+
+	for _, ev := range evicted {
+		c.onEvict(ev.key, ev.value, ev.reason)
 	}
+}
 
-	var keysToPurge []K
-	now := time.Now()
-	for k, v := range c.cache {
-		if v.expiration.Before(now) {
-			keysToPurge = append(keysToPurge, k)
+func (c *Cache[K, V]) removeEntry(ent *entry[K, V], reason EvictReason) {
+	c.policy.Removed(ent.key)
+	delete(c.cache, ent.key)
+	if ent.heapIndex >= 0 {
+		heap.Remove(&c.expiry, ent.heapIndex)
+	}
+	c.cost -= ent.cost
+	for _, tag := range ent.tags {
+		delete(c.tags[tag], ent.key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
 		}
 	}
-	for _, key := range keysToPurge {
-		delete(c.cache, key)
+
+	switch reason {
+	case EvictExpired:
+		c.stats.Expirations++
+	case EvictCapacity:
+		c.stats.Evictions++
 	}
 
-	if len(c.cache) < c.cap {
-		return
+	// Negative entries hold no value to release
+	if ent.err == nil {
+		c.notifyEvict(ent.key, ent.value, reason)
+	}
+}
+
+func (c *Cache[K, V]) notifyEvict(key K, val V, reason EvictReason) {
+	if c.onEvict != nil {
+		c.evicted = append(c.evicted, eviction[K, V]{key, val, reason})
+	}
+}
+
+// ensureCapacity makes room for a new entry with the given cost. Expired
+// entries are purged first, and only if that doesn't free enough room are
+// victims chosen by the eviction policy removed. If the policy is also an
+// AdmissionPolicy and admit is set, it may refuse the new key instead, in which
+// case nothing is evicted and ensureCapacity returns false.
+func (c *Cache[K, V]) ensureCapacity(key K, cost int64, admit bool) bool {
+	if !c.full(cost) {
+		return true
 	}
 
-	numKeysToDelete := c.cap / 2
-	keysToPurge = []K{}
+	c.purgeExpired()
 
-	for k := range c.cache {
-		keysToPurge = append(keysToPurge, k)
-		if len(keysToPurge) >= numKeysToDelete {
+	if admission, ok := c.policy.(AdmissionPolicy[K]); ok && admit && c.full(cost) {
+		if !admission.Admit(key, c.victims(cost)) {
+			return false
+		}
+	}
+
+	now := c.clock.Now()
+	for c.full(cost) && len(c.cache) > 0 {
+		victim, ok := c.policy.Victim()
+		if !ok {
 			break
 		}
+
+		ent, ok := c.cache[victim]
+		if !ok {
+			// Policy is out of sync with the cache; drop the stale key
+			c.policy.Removed(victim)
+			continue
+		}
+
+		if ent.expired(now) {
+			c.removeEntry(ent, EvictExpired)
+		} else {
+			c.removeEntry(ent, EvictCapacity)
+		}
+	}
+
+	return true
+}
+
+// victims returns the keys the policy would evict to make room for an entry
+// with the given cost, or just the first if it isn't a VictimRanger.
+func (c *Cache[K, V]) victims(cost int64) []K {
+	var victims []K
+	var freed int64
+	n := 0
+	now := c.clock.Now()
+	collect := func(key K) bool {
+		if ent, ok := c.cache[key]; ok {
+			// Expired entries make room without displacing anything
+			if !ent.expired(now) {
+				victims = append(victims, key)
+			}
+			freed += ent.cost
+			n++
+		}
+		return c.fullAfter(cost, freed, n)
+	}
+
+	if ranger, ok := c.policy.(VictimRanger[K]); ok {
+		ranger.RangeVictims(collect)
+	} else if victim, ok := c.policy.Victim(); ok {
+		collect(victim)
+	}
+
+	return victims
+}
+
+// entriesByUse returns all entries ordered from least to most recently used.
+func (c *Cache[K, V]) entriesByUse() []*entry[K, V] {
+	entries := make([]*entry[K, V], 0, len(c.cache))
+	for _, ent := range c.cache {
+		entries = append(entries, ent)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUse < entries[j].lastUse
+	})
+
+	return entries
+}
+
+// full reports whether adding an entry with the given cost would exceed the
+// cache's capacity.
+func (c *Cache[K, V]) full(cost int64) bool {
+	return c.fullAfter(cost, 0, 0)
+}
+
+// fullAfter is like full, but as if n entries of total cost freed had been
+// removed first.
+func (c *Cache[K, V]) fullAfter(cost, freed int64, n int) bool {
+	if c.maxCost > 0 {
+		return c.cost-freed+cost > c.maxCost
 	}
+	return len(c.cache)-n >= c.cap
+}
 
-	for _, key := range keysToPurge {
-		delete(c.cache, key)
+// purgeExpired removes all expired entries, taking them from the front of the
+// expiry heap so that the cost is proportional to the number removed.
+func (c *Cache[K, V]) purgeExpired() {
+	now := c.clock.Now()
+	for len(c.expiry) > 0 && c.expiry[0].expired(now) {
+		c.removeEntry(c.expiry[0], EvictExpired)
+	}
+}
+
+// touch resets the entry's expiration to its ttl from now, shortened by jitter.
+func (c *Cache[K, V]) touch(ent *entry[K, V], now time.Time) {
+	if ent.ttl == NoExpiration {
+		c.setExpiration(ent, time.Time{})
+		return
+	}
+	c.setExpiration(ent, now.Add(ent.ttl-c.jitterFor(ent.ttl)))
+}
+
+// setExpiration changes when ent expires, keeping the expiry heap in order.
+// The zero time means never.
+func (c *Cache[K, V]) setExpiration(ent *entry[K, V], expiration time.Time) {
+	ent.expiration = expiration
+	switch {
+	case expiration.IsZero() && ent.heapIndex >= 0:
+		heap.Remove(&c.expiry, ent.heapIndex)
+	case expiration.IsZero():
+	case ent.heapIndex >= 0:
+		heap.Fix(&c.expiry, ent.heapIndex)
+	default:
+		heap.Push(&c.expiry, ent)
 	}
 }
 
 func (c *Cache[K, V]) Add(key K, val V) {
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	defer c.unlock()
+	c.add(key, val, c.ttl)
+}
+
+// AddWithTTL adds an entry that expires after ttl instead of the cache's
+// default TTL. Pass NoExpiration for an entry that never expires. With
+// KeepAlive enabled, reads extend the entry by its own ttl.
+func (c *Cache[K, V]) AddWithTTL(key K, val V, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.unlock()
+	c.add(key, val, ttl)
+}
+
+// AddWithTags adds an entry labelled with tags, so that it can later be
+// removed along with all other entries sharing a tag by InvalidateTag.
+// Replacing the entry with Add drops its tags, while Update, CompareAndSwap
+// and refreshes keep them.
+func (c *Cache[K, V]) AddWithTags(key K, val V, tags ...string) {
+	c.lock.Lock()
+	defer c.unlock()
 
-	ent := entry[K, V]{
-		value:      val,
-		expiration: time.Now().Add(c.ttl),
+	if ent := c.add(key, val, c.ttl); ent != nil {
+		c.tag(ent, tags)
 	}
-	c.ensureCapacity()
-	c.cache[key] = &ent
 }
 
-func (c *Cache[K, V]) Get(key K) (val V, ok bool) {
+func (c *Cache[K, V]) tag(ent *entry[K, V], tags []string) {
+	// Copied so that the caller can't change the tags behind the index
+	ent.tags = append([]string(nil), tags...)
+	for _, tag := range tags {
+		if c.tags[tag] == nil {
+			c.tags[tag] = make(map[K]struct{})
+		}
+		c.tags[tag][ent.key] = struct{}{}
+	}
+}
+
+// InvalidateTag removes all entries added with tag and returns how many there
+// were. A refresh of one of them that is already running won't store its
+// result.
+func (c *Cache[K, V]) InvalidateTag(tag string) int {
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	defer c.unlock()
 
+	n := 0
+	for key := range c.tags[tag] {
+		ent, ok := c.cache[key]
+		if !ok {
+			delete(c.tags[tag], key)
+			continue
+		}
+		c.removeEntry(ent, EvictRemoved)
+		c.invalidateLoads(key)
+		n++
+	}
+	if len(c.tags[tag]) == 0 {
+		delete(c.tags, tag)
+	}
+	return n
+}
+
+// InvalidatePrefix removes all entries of a string-keyed cache whose key starts
+// with prefix and returns how many there were.
+func InvalidatePrefix[V any](c *Cache[string, V], prefix string) int {
+	c.lock.Lock()
+	defer c.unlock()
+
+	n := 0
+	for key, ent := range c.cache {
+		if strings.HasPrefix(key, prefix) {
+			c.removeEntry(ent, EvictRemoved)
+			n++
+		}
+	}
+	for key := range c.calls {
+		if strings.HasPrefix(key, prefix) {
+			c.invalidateLoads(key)
+		}
+	}
+	for b := range c.batches {
+		for _, key := range b.keys {
+			if strings.HasPrefix(key, prefix) {
+				b.invalidated[key] = struct{}{}
+			}
+		}
+	}
+	return n
+}
+
+// AddNegative records that key is known to be missing, or that looking it up
+// failed with err. Get and Peek treat a negative entry as absent, while Lookup
+// and GetOrLoad return its error. If err is nil, ErrNotFound is stored. The
+// entry expires after the NegativeTTL, or the cache's TTL if that isn't set.
+func (c *Cache[K, V]) AddNegative(key K, err error) {
+	c.lock.Lock()
+	defer c.unlock()
+	c.addNegative(key, err)
+}
+
+func (c *Cache[K, V]) addNegative(key K, err error) {
+	if err == nil {
+		err = ErrNotFound
+	}
+
+	ttl := c.ttl
+	if c.negativeTTL != 0 {
+		ttl = c.negativeTTL
+	}
+
+	var zero V
+	if ent := c.add(key, zero, ttl); ent != nil {
+		ent.err = err
+	}
+}
+
+// add stores the value and returns its entry, or nil if its cost is too large
+// for the cache to hold at all.
+func (c *Cache[K, V]) add(key K, val V, ttl time.Duration) *entry[K, V] {
+	now := c.clock.Now()
+
+	// Replacing a value always succeeds, so it isn't subject to admission
+	ent, replacing := c.cache[key]
+	if replacing {
+		c.removeEntry(ent, EvictReplaced)
+	}
+
+	cost := int64(1)
+	if c.weigher != nil {
+		cost = c.weigher(key, val)
+	}
+	if (c.maxCost > 0 && cost > c.maxCost) || !c.ensureCapacity(key, cost, !replacing) {
+		c.stats.Evictions++
+		c.notifyEvict(key, val, EvictCapacity)
+		return nil
+	}
+
+	c.tick++
+	ent = &entry[K, V]{
+		key:       key,
+		value:     val,
+		ttl:       ttl,
+		updated:   now,
+		cost:      cost,
+		lastUse:   c.tick,
+		heapIndex: -1,
+	}
+	c.cache[key] = ent
+	c.touch(ent, now)
+	c.policy.Added(key)
+	c.cost += cost
+
+	return ent
+}
+
+// replace is like add, but the new entry keeps the tags of the one it
+// replaces, for changes to an existing entry rather than a fresh Add.
+func (c *Cache[K, V]) replace(key K, val V, ttl time.Duration) *entry[K, V] {
+	var tags []string
+	if old, ok := c.cache[key]; ok {
+		tags = old.tags
+	}
+
+	ent := c.add(key, val, ttl)
+	if ent != nil {
+		c.tag(ent, tags)
+	}
+	return ent
+}
+
+// Update atomically replaces the value for key with the result of fn, which is
+// passed the current value and whether one exists. If fn returns false as its
+// second result, the entry is removed instead (or not created). An updated
+// entry keeps its own TTL and restarts it. fn runs with the cache locked, so
+// it must not use the cache. Update returns the new value and whether it was
+// stored.
+func (c *Cache[K, V]) Update(key K, fn func(old V, exists bool) (V, bool)) (V, bool) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	var old V
+	ttl := c.ttl
+	ent := c.live(key)
+	if ent != nil {
+		old, ttl = ent.value, ent.ttl
+	}
+
+	val, keep := fn(old, ent != nil)
+	if !keep {
+		if ent != nil {
+			c.removeEntry(ent, EvictRemoved)
+		}
+		var zero V
+		return zero, false
+	}
+
+	return val, c.replace(key, val, ttl) != nil
+}
+
+// AddIfAbsent adds the value only if there is no unexpired entry for key, and
+// reports whether it did.
+func (c *Cache[K, V]) AddIfAbsent(key K, val V) bool {
+	c.lock.Lock()
+	defer c.unlock()
+
+	if c.live(key) != nil {
+		return false
+	}
+	return c.add(key, val, c.ttl) != nil
+}
+
+// CompareAndSwap replaces the value for key with new only if an unexpired entry
+// exists and its value equals old, and reports whether it did.
+func CompareAndSwap[K, V comparable](c *Cache[K, V], key K, old, new V) bool {
+	c.lock.Lock()
+	defer c.unlock()
+
+	ent := c.live(key)
+	if ent == nil || ent.value != old {
+		return false
+	}
+	return c.replace(key, new, ent.ttl) != nil
+}
+
+// live returns the unexpired, non-negative entry for key, or nil. An expired
+// entry is removed. Unlike get, it doesn't count as a use.
+func (c *Cache[K, V]) live(key K) *entry[K, V] {
 	ent, ok := c.cache[key]
 	if !ok {
-		return val, false
+		return nil
 	}
+	if ent.expired(c.clock.Now()) {
+		c.removeEntry(ent, EvictExpired)
+		return nil
+	}
+	if ent.err != nil {
+		return nil
+	}
+	return ent
+}
 
-	if ent.expiration.Before(time.Now()) {
-		delete(c.cache, key)
+func (c *Cache[K, V]) Get(key K) (val V, ok bool) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	ent := c.get(key)
+	if ent == nil || ent.err != nil {
 		return val, false
 	}
+	return ent.value, true
+}
+
+// Lookup is like Get but distinguishes a negative entry from one that isn't
+// cached: ok reports whether key was found at all, and err holds the error of
+// a negative entry.
+func (c *Cache[K, V]) Lookup(key K) (val V, ok bool, err error) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	ent := c.get(key)
+	if ent == nil {
+		return val, false, nil
+	}
+	return ent.value, true, ent.err
+}
+
+// get returns the unexpired entry for key, or nil, and records the read.
+func (c *Cache[K, V]) get(key K) *entry[K, V] {
+	ent, ok := c.cache[key]
+	if !ok {
+		c.stats.Misses++
+		return nil
+	}
+
+	now := c.clock.Now()
+	if ent.expired(now) {
+		c.removeEntry(ent, EvictExpired)
+		c.stats.Misses++
+		return nil
+	}
+	c.stats.Hits++
 	if c.keepAlive {
-		ent.expiration = time.Now().Add(c.ttl)
+		c.touch(ent, now)
 	}
+	c.tick++
+	ent.lastUse = c.tick
+	c.policy.Accessed(key)
+
+	if c.refresh != nil && ent.err == nil && now.Sub(ent.updated) >= c.refreshAfter {
+		c.startRefresh(key, ent.ttl)
+	}
+
+	return ent
+}
+
+func (c *Cache[K, V]) startRefresh(key K, ttl time.Duration) {
+	if _, ok := c.calls[key]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cl := &call[V]{
+		done:    make(chan struct{}),
+		cancel:  cancel,
+		refresh: true,
+	}
+	c.calls[key] = cl
+
+	refresh := c.refresh
+	go c.load(ctx, key, ttl, cl, func(ctx context.Context) (V, error) {
+		return refresh(ctx, key)
+	})
+}
 
+// GetOrLoad returns the cached value for key, calling load to fetch and cache
+// it on a miss. Concurrent callers for the same key share a single load. If
+// ctx is done before the value is available, ctx.Err() is returned; the load
+// itself is only cancelled once every caller waiting on it has gone away, and
+// none is started on a miss if ctx is already done.
+// Errors from load are returned to all waiting callers and are only cached if
+// NegativeTTL is set. If load panics, the panic is raised again in every
+// waiting caller and nothing is cached.
+func (c *Cache[K, V]) GetOrLoad(ctx context.Context, key K, load func(context.Context) (V, error)) (V, error) {
+	c.lock.Lock()
+	if ent := c.get(key); ent != nil {
+		c.unlock()
+		return ent.value, ent.err
+	}
+
+	// Don't start a load that nobody will wait for
+	if err := ctx.Err(); err != nil {
+		c.unlock()
+		var zero V
+		return zero, err
+	}
+
+	cl, ok := c.calls[key]
+	if !ok {
+		loadCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		cl = &call[V]{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		c.calls[key] = cl
+		go c.load(loadCtx, key, c.ttl, cl, load)
+	}
+	cl.waiters++
+	c.unlock()
+
+	select {
+	case <-cl.done:
+		if cl.panic != nil {
+			panic(cl.panic)
+		}
+		return cl.val, cl.err
+	case <-ctx.Done():
+		c.lock.Lock()
+		cl.waiters--
+		if cl.waiters == 0 {
+			cl.cancel()
+			if c.calls[key] == cl {
+				delete(c.calls, key)
+			}
+		}
+		c.unlock()
+
+		var zero V
+		return zero, ctx.Err()
+	}
+}
+
+func (c *Cache[K, V]) load(ctx context.Context, key K, ttl time.Duration, cl *call[V], load func(context.Context) (V, error)) {
+	defer cl.cancel()
+
+	val, recovered, err := recoverLoad(ctx, load)
+
+	c.lock.Lock()
+	switch {
+	case cl.gen != 0:
+		// Invalidated while loading
+	case recovered != nil:
+	case err == nil:
+		c.replace(key, val, ttl)
+	case c.negativeTTL != 0 && !cl.refresh && !isContextErr(err):
+		c.addNegative(key, err)
+	}
+	if c.calls[key] == cl {
+		delete(c.calls, key)
+	}
+	c.unlock()
+
+	cl.val, cl.err, cl.panic = val, err, recovered
+	close(cl.done)
+}
+
+// recoverLoad calls load, recovering any panic so that it can be passed to the
+// callers waiting on the load rather than crashing the process.
+func recoverLoad[V any](ctx context.Context, load func(context.Context) (V, error)) (val V, recovered any, err error) {
+	defer func() {
+		recovered = recover()
+	}()
+	val, err = load(ctx)
+	return val, nil, err
+}
+
+// GetMany looks up several keys under a single lock acquisition. It returns
+// the values found and the keys that were not, with negative entries counting
+// as not found as in Get.
+func (c *Cache[K, V]) GetMany(keys []K) (map[K]V, []K) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	hits, misses, negative := c.getMany(keys)
+	return hits, append(misses, negative...)
+}
+
+// getMany splits keys into values found, keys not cached, and keys with
+// negative entries. Duplicate keys are only reported once.
+func (c *Cache[K, V]) getMany(keys []K) (hits map[K]V, misses, negative []K) {
+	hits = make(map[K]V, len(keys))
+	seen := make(map[K]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		switch ent := c.get(key); {
+		case ent == nil:
+			misses = append(misses, key)
+		case ent.err != nil:
+			negative = append(negative, key)
+		default:
+			hits[key] = ent.value
+		}
+	}
+	return hits, misses, negative
+}
+
+// AddMany adds all of the values under a single lock acquisition.
+func (c *Cache[K, V]) AddMany(vals map[K]V) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	for key, val := range vals {
+		c.add(key, val, c.ttl)
+	}
+}
+
+// GetManyOrLoad returns the cached values for keys, fetching all misses with
+// a single call to load and caching its results. Keys that load doesn't
+// return are left out of the result, and stored as negative entries if
+// NegativeTTL is set; keys that already have negative entries are not loaded.
+// Unlike GetOrLoad, concurrent batches are not coalesced.
+func (c *Cache[K, V]) GetManyOrLoad(ctx context.Context, keys []K, load func(ctx context.Context, keys []K) (map[K]V, error)) (map[K]V, error) {
+	c.lock.Lock()
+	hits, misses, _ := c.getMany(keys)
+	b := c.startBatch(misses)
+	c.unlock()
+
+	if b == nil {
+		return hits, nil
+	}
+
+	loaded, err := load(ctx, misses)
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	if err != nil {
+		delete(c.batches, b)
+		return nil, err
+	}
+	c.finishBatch(b, loaded, hits)
+
+	return hits, nil
+}
+
+// startBatch registers a batch load of keys, or returns nil if there are none.
+func (c *Cache[K, V]) startBatch(keys []K) *batchLoad[K] {
+	if len(keys) == 0 {
+		return nil
+	}
+	b := &batchLoad[K]{keys: keys, invalidated: make(map[K]struct{})}
+	c.batches[b] = struct{}{}
+	return b
+}
+
+// finishBatch adds the loaded values to hits and caches them, along with
+// negative entries for missing keys, except for keys invalidated meanwhile.
+func (c *Cache[K, V]) finishBatch(b *batchLoad[K], loaded, hits map[K]V) {
+	delete(c.batches, b)
+
+	for _, key := range b.keys {
+		if val, ok := loaded[key]; ok {
+			hits[key] = val
+			if b.valid(key) {
+				c.add(key, val, c.ttl)
+			}
+		} else if c.negativeTTL != 0 && b.valid(key) {
+			c.addNegative(key, nil)
+		}
+	}
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Peek returns the value for key without counting as a use: it doesn't extend
+// the entry's expiration, affect eviction order or statistics, or trigger a
+// refresh.
+func (c *Cache[K, V]) Peek(key K) (val V, ok bool) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	ent, ok := c.cache[key]
+	if !ok || ent.expired(c.clock.Now()) || ent.err != nil {
+		return val, false
+	}
 	return ent.value, true
 }
+
+// Len returns the number of unexpired entries, not counting negative ones.
+func (c *Cache[K, V]) Len() int {
+	c.lock.Lock()
+	defer c.unlock()
+
+	n := 0
+	now := c.clock.Now()
+	for _, ent := range c.cache {
+		if !ent.expired(now) && ent.err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Keys returns the keys of all unexpired, non-negative entries, in no
+// particular order.
+func (c *Cache[K, V]) Keys() []K {
+	c.lock.Lock()
+	defer c.unlock()
+
+	keys := make([]K, 0, len(c.cache))
+	now := c.clock.Now()
+	for key, ent := range c.cache {
+		if !ent.expired(now) && ent.err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Range calls fn for each unexpired, non-negative entry until fn returns false. It works on
+// a copy taken when Range is called, so fn may use the cache, and the entries
+// are not counted as used.
+func (c *Cache[K, V]) Range(fn func(key K, val V) bool) {
+	c.lock.Lock()
+	now := c.clock.Now()
+	entries := make([]keyValue[K, V], 0, len(c.cache))
+	for key, ent := range c.cache {
+		if !ent.expired(now) && ent.err == nil {
+			entries = append(entries, keyValue[K, V]{key, ent.value})
+		}
+	}
+	c.unlock()
+
+	for _, ent := range entries {
+		if !fn(ent.key, ent.value) {
+			return
+		}
+	}
+}
+
+type keyValue[K comparable, V any] struct {
+	key   K
+	value V
+}
@@ -0,0 +1,180 @@
+package mu
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CacheInfo describes a published cache, as shown in expvar and by
+// CacheDebugHandler.
+type CacheInfo struct {
+	Name        string  `json:"name"`
+	Size        int     `json:"size"`
+	Cap         int     `json:"cap"` // 0 if unbounded
+	Cost        int64   `json:"cost"`
+	MaxCost     int64   `json:"max_cost"` // 0 if unbounded
+	TTL         string  `json:"ttl"`      // "0s" if entries don't expire
+	Hits        uint64  `json:"hits"`
+	Misses      uint64  `json:"misses"`
+	HitRate     float64 `json:"hit_rate"`
+	Expirations uint64  `json:"expirations"`
+	Evictions   uint64  `json:"evictions"`
+}
+
+// publishedCache is the part of a cache the registry needs, independent of
+// its key and value types.
+type publishedCache interface {
+	info() CacheInfo
+	Clear()
+}
+
+var (
+	cacheRegistryLock sync.Mutex
+	cacheRegistry     = make(map[string]publishedCache)
+)
+
+// Publish registers the cache under name, making its size, capacity, TTL and
+// counters visible in expvar (as "cache.<name>") and through
+// CacheDebugHandler. Publishing another cache under the same name replaces it.
+func (c *Cache[K, V]) Publish(name string) *Cache[K, V] {
+	publishCache(name, c)
+	return c
+}
+
+func (c *Cache[K, V]) info() CacheInfo {
+	c.lock.Lock()
+	cap, maxCost, ttl := c.cap, c.maxCost, c.ttl
+	c.lock.Unlock()
+
+	return newCacheInfo(c.Stats(), cap, maxCost, ttl)
+}
+
+// Publish registers the cache under name, like Cache.Publish, reporting the
+// totals across all shards.
+func (c *ShardedCache[K, V]) Publish(name string) *ShardedCache[K, V] {
+	publishCache(name, c)
+	return c
+}
+
+func (c *ShardedCache[K, V]) info() CacheInfo {
+	var cap int
+	var maxCost int64
+	for _, s := range c.shards {
+		info := s.info()
+		cap += info.Cap
+		maxCost += info.MaxCost
+	}
+
+	s := c.shards[0]
+	s.lock.Lock()
+	ttl := s.ttl
+	s.lock.Unlock()
+
+	return newCacheInfo(c.Stats(), cap, maxCost, ttl)
+}
+
+func newCacheInfo(stats CacheStats, cap int, maxCost int64, ttl time.Duration) CacheInfo {
+	info := CacheInfo{
+		Size:        stats.Size,
+		Cap:         cap,
+		Cost:        stats.Cost,
+		MaxCost:     maxCost,
+		TTL:         ttl.String(),
+		Hits:        stats.Hits,
+		Misses:      stats.Misses,
+		Expirations: stats.Expirations,
+		Evictions:   stats.Evictions,
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		info.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return info
+}
+
+func publishCache(name string, c publishedCache) {
+	cacheRegistryLock.Lock()
+	defer cacheRegistryLock.Unlock()
+
+	// expvar names can't be reused, so the variable is created once and looks
+	// up whichever cache currently has the name.
+	if _, ok := cacheRegistry[name]; !ok && expvar.Get("cache."+name) == nil {
+		expvar.Publish("cache."+name, expvar.Func(func() any {
+			info, _ := cacheInfo(name)
+			return info
+		}))
+	}
+	cacheRegistry[name] = c
+}
+
+// Unpublish removes a cache from CacheDebugHandler. Its expvar variable remains
+// but reports nothing until a cache is published under the name again.
+func Unpublish(name string) {
+	cacheRegistryLock.Lock()
+	defer cacheRegistryLock.Unlock()
+	delete(cacheRegistry, name)
+}
+
+func cacheInfo(name string) (*CacheInfo, bool) {
+	cacheRegistryLock.Lock()
+	c, ok := cacheRegistry[name]
+	cacheRegistryLock.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+	info := c.info()
+	info.Name = name
+	return &info, true
+}
+
+// PublishedCaches returns information about every published cache, sorted by
+// name.
+func PublishedCaches() []CacheInfo {
+	cacheRegistryLock.Lock()
+	names := make([]string, 0, len(cacheRegistry))
+	for name := range cacheRegistry {
+		names = append(names, name)
+	}
+	cacheRegistryLock.Unlock()
+	sort.Strings(names)
+
+	infos := make([]CacheInfo, 0, len(names))
+	for _, name := range names {
+		if info, ok := cacheInfo(name); ok {
+			infos = append(infos, *info)
+		}
+	}
+	return infos
+}
+
+// CacheDebugHandler returns a handler for operators. A GET lists all published
+// caches as JSON, and a POST with a "clear" form value naming a cache clears
+// it.
+func CacheDebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(PublishedCaches())
+		case http.MethodPost:
+			name := r.FormValue("clear")
+			cacheRegistryLock.Lock()
+			c, ok := cacheRegistry[name]
+			cacheRegistryLock.Unlock()
+
+			if !ok {
+				http.Error(w, "unknown cache "+name, http.StatusNotFound)
+				return
+			}
+			c.Clear()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package mu
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachePublish(t *testing.T) {
+	cache := NewCache[string, int]().Cap(10).TTL(time.Minute).Publish("test-users")
+	defer Unpublish("test-users")
+
+	cache.Add("a", 1)
+	cache.Get("a")
+	cache.Get("b")
+
+	var info CacheInfo
+	assert.NoError(t, json.Unmarshal([]byte(expvar.Get("cache.test-users").String()), &info))
+	assert.Equal(t, CacheInfo{
+		Name:    "test-users",
+		Size:    1,
+		Cap:     10,
+		Cost:    1,
+		TTL:     "1m0s",
+		Hits:    1,
+		Misses:  1,
+		HitRate: 0.5,
+	}, info)
+
+	// Publishing again under the same name replaces the cache
+	NewCache[string, int]().Publish("test-users")
+	assert.Equal(t, 0, PublishedCaches()[0].Size)
+
+	Unpublish("test-users")
+	assert.Equal(t, "null", expvar.Get("cache.test-users").String())
+}
+
+func TestCacheDebugHandler(t *testing.T) {
+	users := NewCache[string, int]().Publish("test-a")
+	defer Unpublish("test-a")
+	sessions := NewShardedCache[int, string](2).Cap(20).Publish("test-b")
+	defer Unpublish("test-b")
+
+	users.Add("a", 1)
+	sessions.Add(1, "x")
+	sessions.Add(2, "y")
+
+	handler := CacheDebugHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var infos []CacheInfo
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &infos))
+	assert.Len(t, infos, 2)
+	assert.Equal(t, "test-a", infos[0].Name)
+	assert.Equal(t, 1, infos[0].Size)
+	assert.Equal(t, "test-b", infos[1].Name)
+	assert.Equal(t, 2, infos[1].Size)
+	assert.Equal(t, 20, infos[1].Cap)
+
+	clearCache := func(name string) int {
+		form := url.Values{"clear": {name}}
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, clearCache("test-b"))
+	assert.Equal(t, 0, sessions.Len())
+	assert.Equal(t, 1, users.Len())
+
+	assert.Equal(t, http.StatusNotFound, clearCache("missing"))
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
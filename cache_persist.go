@@ -0,0 +1,106 @@
+package mu
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"time"
+)
+
+type cacheSnapshot[K comparable, V any] struct {
+	Entries []cacheSnapshotEntry[K, V]
+}
+
+type cacheSnapshotEntry[K comparable, V any] struct {
+	Key        K
+	Value      V
+	TTL        time.Duration
+	Expiration time.Time // zero if the entry never expires
+}
+
+// Save writes all unexpired entries and their expiration times to w using
+// encoding/gob, so K and V must be gob-encodable. Negative entries are not
+// saved.
+func (c *Cache[K, V]) Save(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(c.snapshot())
+}
+
+// Load reads entries written by Save and adds them to the cache with the
+// expiration they had when saved. Entries that have expired since are skipped.
+func (c *Cache[K, V]) Load(r io.Reader) error {
+	var snap cacheSnapshot[K, V]
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return err
+	}
+	c.restore(snap)
+
+	return nil
+}
+
+// SaveEncrypted is like Save but encrypts the snapshot with key using Encrypt.
+func (c *Cache[K, V]) SaveEncrypted(w io.Writer, key []byte) error {
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		return err
+	}
+
+	_, err := w.Write(Encrypt(buf.Bytes(), key))
+	return err
+}
+
+// LoadEncrypted loads a snapshot written by SaveEncrypted.
+func (c *Cache[K, V]) LoadEncrypted(r io.Reader, key []byte) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := Decrypt(data, key)
+	if err != nil {
+		return err
+	}
+
+	return c.Load(bytes.NewReader(plaintext))
+}
+
+func (c *Cache[K, V]) snapshot() cacheSnapshot[K, V] {
+	c.lock.Lock()
+	defer c.unlock()
+
+	now := c.clock.Now()
+	snap := cacheSnapshot[K, V]{
+		Entries: make([]cacheSnapshotEntry[K, V], 0, len(c.cache)),
+	}
+
+	// Save from least to most recently used so that restoring preserves order
+	for _, ent := range c.entriesByUse() {
+		if ent.expired(now) || ent.err != nil {
+			continue
+		}
+
+		snap.Entries = append(snap.Entries, cacheSnapshotEntry[K, V]{
+			Key:        ent.key,
+			Value:      ent.value,
+			TTL:        ent.ttl,
+			Expiration: ent.expiration,
+		})
+	}
+
+	return snap
+}
+
+func (c *Cache[K, V]) restore(snap cacheSnapshot[K, V]) {
+	c.lock.Lock()
+	defer c.unlock()
+
+	now := c.clock.Now()
+	for _, se := range snap.Entries {
+		if !se.Expiration.IsZero() && se.Expiration.Before(now) {
+			continue
+		}
+
+		if ent := c.add(se.Key, se.Value, se.TTL); ent != nil {
+			c.setExpiration(ent, se.Expiration)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package mu
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheSaveLoad(t *testing.T) {
+	clock := &Time{}
+	cache := NewCache[string, int]().Clock(clock).TTL(time.Minute)
+
+	cache.Add("a", 1)
+	cache.AddWithTTL("b", 2, 10*time.Second)
+	cache.AddWithTTL("c", 3, NoExpiration)
+	cache.AddWithTTL("expired", 4, time.Second)
+
+	clock.Advance(5 * time.Second)
+
+	var buf bytes.Buffer
+	assert.NoError(t, cache.Save(&buf))
+
+	restored := NewCache[string, int]().Clock(clock)
+	assert.NoError(t, restored.Load(&buf))
+	assert.Equal(t, 3, restored.Stats().Size, "Expired entries should not be saved")
+
+	for k, v := range map[string]int{"a": 1, "b": 2, "c": 3} {
+		val, ok := restored.Get(k)
+		assert.True(t, ok, "Key %q should have been restored", k)
+		assert.Equal(t, v, val)
+	}
+
+	// Expirations carry over
+	clock.Advance(6 * time.Second)
+	_, ok := restored.Get("b")
+	assert.False(t, ok, "Key 'b' should have expired")
+	_, ok = restored.Get("a")
+	assert.True(t, ok)
+
+	clock.Advance(time.Hour)
+	_, ok = restored.Get("a")
+	assert.False(t, ok, "Key 'a' should have expired")
+	_, ok = restored.Get("c")
+	assert.True(t, ok, "Key 'c' should never expire")
+}
+
+func TestCacheLoad_SkipsExpiredSinceSave(t *testing.T) {
+	clock := &Time{}
+	cache := NewCache[string, int]().Clock(clock).TTL(time.Minute)
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+	cache.AddWithTTL("c", 3, time.Hour)
+
+	var buf bytes.Buffer
+	assert.NoError(t, cache.Save(&buf))
+
+	clock.Advance(2 * time.Minute)
+	restored := NewCache[string, int]().Clock(clock)
+	assert.NoError(t, restored.Load(&buf))
+	assert.Equal(t, 1, restored.Stats().Size)
+	_, ok := restored.Get("c")
+	assert.True(t, ok)
+}
+
+func TestCacheSaveLoad_PreservesRecency(t *testing.T) {
+	cache := NewCache[int, int]()
+	cache.Add(1, 1)
+	cache.Add(2, 2)
+	cache.Add(3, 3)
+	cache.Get(1)
+
+	var buf bytes.Buffer
+	assert.NoError(t, cache.Save(&buf))
+
+	// With a smaller capacity only the most recently used entries survive
+	restored := NewCache[int, int]().Cap(2)
+	assert.NoError(t, restored.Load(&buf))
+
+	_, ok := restored.Get(2)
+	assert.False(t, ok, "Least recently used entry should have been evicted")
+	_, ok = restored.Get(1)
+	assert.True(t, ok)
+	_, ok = restored.Get(3)
+	assert.True(t, ok)
+}
+
+func TestCacheSaveLoadEncrypted(t *testing.T) {
+	key := RandBytes(32)
+	cache := NewCache[string, string]()
+	cache.Add("secret", "attack at dawn")
+
+	var buf bytes.Buffer
+	assert.NoError(t, cache.SaveEncrypted(&buf, key))
+	assert.NotContains(t, buf.String(), "attack at dawn")
+
+	data := buf.Bytes()
+
+	restored := NewCache[string, string]()
+	assert.NoError(t, restored.LoadEncrypted(bytes.NewReader(data), key))
+	val, ok := restored.Get("secret")
+	assert.True(t, ok)
+	assert.Equal(t, "attack at dawn", val)
+
+	err := NewCache[string, string]().LoadEncrypted(bytes.NewReader(data), RandBytes(32))
+	assert.Error(t, err, "Loading with the wrong key should fail")
+}
@@ -0,0 +1,373 @@
+package mu
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+// EvictionPolicy decides which entry a Cache evicts when it is full. The cache
+// reports every key it stores, reads and drops, and asks for a Victim when it
+// needs room. Methods are called with the cache lock held, so implementations
+// need no locking of their own but must not call back into the cache. A policy
+// instance belongs to a single cache.
+type EvictionPolicy[K comparable] interface {
+	Added(key K)
+	Accessed(key K)
+	Removed(key K)
+	Victim() (key K, ok bool)
+	Clear()
+}
+
+// AdmissionPolicy may additionally be implemented by an EvictionPolicy to
+// reject new entries. When the cache is full, a candidate is only stored if
+// Admit returns true for it and the victims that would be evicted in its
+// place. Admit is called once per candidate, before any victim is removed.
+type AdmissionPolicy[K comparable] interface {
+	Admit(candidate K, victims []K) bool
+}
+
+// VictimRanger may additionally be implemented by an EvictionPolicy to list
+// the keys it would evict, in order, without removing them. It lets the cache
+// pass an AdmissionPolicy every victim a new entry would displace; without it
+// only the first victim is known in advance.
+type VictimRanger[K comparable] interface {
+	RangeVictims(fn func(key K) bool)
+}
+
+// lruPolicy evicts the least recently used key.
+type lruPolicy[K comparable] struct {
+	order *list.List // front is most recently used
+	elems map[K]*list.Element
+}
+
+func NewLRUPolicy[K comparable]() EvictionPolicy[K] {
+	return &lruPolicy[K]{
+		order: list.New(),
+		elems: make(map[K]*list.Element),
+	}
+}
+
+func (p *lruPolicy[K]) Added(key K) {
+	p.elems[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy[K]) Accessed(key K) {
+	if e, ok := p.elems[key]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy[K]) Removed(key K) {
+	if e, ok := p.elems[key]; ok {
+		p.order.Remove(e)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lruPolicy[K]) Victim() (key K, ok bool) {
+	e := p.order.Back()
+	if e == nil {
+		return key, false
+	}
+	return e.Value.(K), true
+}
+
+func (p *lruPolicy[K]) RangeVictims(fn func(key K) bool) {
+	for e := p.order.Back(); e != nil; e = e.Prev() {
+		if !fn(e.Value.(K)) {
+			return
+		}
+	}
+}
+
+func (p *lruPolicy[K]) Clear() {
+	p.order.Init()
+	clear(p.elems)
+}
+
+// fifoPolicy evicts the oldest key, regardless of how often it is read.
+type fifoPolicy[K comparable] struct {
+	lruPolicy[K]
+}
+
+func NewFIFOPolicy[K comparable]() EvictionPolicy[K] {
+	return &fifoPolicy[K]{
+		lruPolicy: lruPolicy[K]{
+			order: list.New(),
+			elems: make(map[K]*list.Element),
+		},
+	}
+}
+
+func (p *fifoPolicy[K]) Accessed(key K) {}
+
+// lfuPolicy evicts the least frequently used key, choosing the least recently
+// used one among keys with the same count.
+type lfuPolicy[K comparable] struct {
+	items lfuHeap[K]
+	index map[K]*lfuItem[K]
+	tick  uint64
+}
+
+type lfuItem[K comparable] struct {
+	key   K
+	freq  uint64
+	tick  uint64 // last use, to break ties
+	index int    // position in the heap
+}
+
+func NewLFUPolicy[K comparable]() EvictionPolicy[K] {
+	return &lfuPolicy[K]{
+		index: make(map[K]*lfuItem[K]),
+	}
+}
+
+func (p *lfuPolicy[K]) Added(key K) {
+	p.tick++
+	item := &lfuItem[K]{key: key, freq: 1, tick: p.tick}
+	p.index[key] = item
+	heap.Push(&p.items, item)
+}
+
+func (p *lfuPolicy[K]) Accessed(key K) {
+	item, ok := p.index[key]
+	if !ok {
+		return
+	}
+	p.tick++
+	item.freq++
+	item.tick = p.tick
+	heap.Fix(&p.items, item.index)
+}
+
+func (p *lfuPolicy[K]) Removed(key K) {
+	item, ok := p.index[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&p.items, item.index)
+	delete(p.index, key)
+}
+
+func (p *lfuPolicy[K]) Victim() (key K, ok bool) {
+	if len(p.items) == 0 {
+		return key, false
+	}
+	return p.items[0].key, true
+}
+
+// RangeVictims walks the heap in order without modifying it, using a second
+// heap of the positions that could hold the next smallest item.
+func (p *lfuPolicy[K]) RangeVictims(fn func(key K) bool) {
+	if len(p.items) == 0 {
+		return
+	}
+
+	next := &lfuFrontier[K]{items: p.items, idx: []int{0}}
+	for next.Len() > 0 {
+		i := heap.Pop(next).(int)
+		if !fn(p.items[i].key) {
+			return
+		}
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(p.items) {
+				heap.Push(next, child)
+			}
+		}
+	}
+}
+
+func (p *lfuPolicy[K]) Clear() {
+	p.items = nil
+	clear(p.index)
+}
+
+type lfuHeap[K comparable] []*lfuItem[K]
+
+func (h lfuHeap[K]) Len() int { return len(h) }
+
+func (h lfuHeap[K]) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap[K]) Push(x any) {
+	item := x.(*lfuItem[K])
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap[K]) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// lfuFrontier is a heap of positions in an lfuHeap, ordered by their items.
+type lfuFrontier[K comparable] struct {
+	items lfuHeap[K]
+	idx   []int
+}
+
+func (f *lfuFrontier[K]) Len() int           { return len(f.idx) }
+func (f *lfuFrontier[K]) Less(i, j int) bool { return f.items.Less(f.idx[i], f.idx[j]) }
+func (f *lfuFrontier[K]) Swap(i, j int)      { f.idx[i], f.idx[j] = f.idx[j], f.idx[i] }
+func (f *lfuFrontier[K]) Push(x any)         { f.idx = append(f.idx, x.(int)) }
+
+func (f *lfuFrontier[K]) Pop() any {
+	i := f.idx[len(f.idx)-1]
+	f.idx = f.idx[:len(f.idx)-1]
+	return i
+}
+
+// tinyLFUPolicy wraps another policy with a TinyLFU admission filter: a small
+// count-min sketch estimates how often each key has been seen recently, and a
+// new key is only admitted if it is seen more often than the victim it would
+// replace. This keeps one-off keys from a scan from flushing out hot entries.
+type tinyLFUPolicy[K comparable] struct {
+	EvictionPolicy[K]
+	sketch *countMinSketch
+	hash   func(K) uint64
+}
+
+// NewTinyLFUPolicy returns a policy that evicts according to inner (LRU if
+// nil) and filters admissions by access frequency. capacity is the expected
+// number of entries in the cache and sizes the frequency sketch.
+func NewTinyLFUPolicy[K comparable](inner EvictionPolicy[K], capacity int) EvictionPolicy[K] {
+	if inner == nil {
+		inner = NewLRUPolicy[K]()
+	}
+	return &tinyLFUPolicy[K]{
+		EvictionPolicy: inner,
+		sketch:         newCountMinSketch(capacity),
+		hash:           newHasher[K](),
+	}
+}
+
+func (p *tinyLFUPolicy[K]) Added(key K) {
+	p.sketch.increment(p.hash(key))
+	p.EvictionPolicy.Added(key)
+}
+
+func (p *tinyLFUPolicy[K]) Accessed(key K) {
+	p.sketch.increment(p.hash(key))
+	p.EvictionPolicy.Accessed(key)
+}
+
+// Admit admits candidate only if it is seen more often than the hottest of
+// the victims.
+func (p *tinyLFUPolicy[K]) Admit(candidate K, victims []K) bool {
+	// Count the attempt so that a key that keeps being requested is eventually
+	// admitted.
+	c := p.hash(candidate)
+	p.sketch.increment(c)
+
+	est := p.sketch.estimate(c)
+	for _, victim := range victims {
+		if p.sketch.estimate(p.hash(victim)) >= est {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *tinyLFUPolicy[K]) RangeVictims(fn func(key K) bool) {
+	if ranger, ok := p.EvictionPolicy.(VictimRanger[K]); ok {
+		ranger.RangeVictims(fn)
+	} else if victim, ok := p.EvictionPolicy.Victim(); ok {
+		fn(victim)
+	}
+}
+
+const (
+	sketchDepth      = 4
+	sketchMaxCounter = 15
+)
+
+// countMinSketch is a fixed-size approximate frequency counter. Counters
+// saturate at sketchMaxCounter and are all halved periodically so that old
+// popularity fades.
+type countMinSketch struct {
+	rows      [sketchDepth][]uint8
+	shift     uint // 64 - log2(row width)
+	additions int
+	resetAt   int
+}
+
+// sketchSeeds are odd multipliers used to derive an independent index for
+// each row from a single key hash.
+var sketchSeeds = [sketchDepth]uint64{
+	0x9e3779b97f4a7c15,
+	0xbf58476d1ce4e5b9,
+	0x94d049bb133111eb,
+	0xc2b2ae3d27d4eb4f,
+}
+
+func newCountMinSketch(capacity int) *countMinSketch {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	// Several counters per expected entry keep collisions between keys rare
+	width, bits := 16, uint(4)
+	for width < capacity*8 {
+		width <<= 1
+		bits++
+	}
+
+	s := &countMinSketch{
+		shift:   64 - bits,
+		resetAt: capacity * 10,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) index(hash uint64, row int) uint64 {
+	return (hash * sketchSeeds[row]) >> s.shift
+}
+
+func (s *countMinSketch) increment(hash uint64) {
+	for i := range s.rows {
+		idx := s.index(hash, i)
+		if s.rows[i][idx] < sketchMaxCounter {
+			s.rows[i][idx]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.age()
+	}
+}
+
+func (s *countMinSketch) estimate(hash uint64) uint8 {
+	est := uint8(sketchMaxCounter)
+	for i := range s.rows {
+		if v := s.rows[i][s.index(hash, i)]; v < est {
+			est = v
+		}
+	}
+	return est
+}
+
+func (s *countMinSketch) age() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
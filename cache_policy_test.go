@@ -0,0 +1,211 @@
+package mu
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cachedKeys(cache *Cache[int, int], keys ...int) []int {
+	var present []int
+	for _, k := range keys {
+		if _, ok := cache.cache[k]; ok {
+			present = append(present, k)
+		}
+	}
+	return present
+}
+
+func TestLRUPolicy(t *testing.T) {
+	cache := NewCache[int, int]().Cap(3).Policy(NewLRUPolicy[int]())
+	cache.Add(1, 1)
+	cache.Add(2, 2)
+	cache.Add(3, 3)
+	cache.Get(1)
+	cache.Add(4, 4)
+
+	assert.Equal(t, []int{1, 3, 4}, cachedKeys(cache, 1, 2, 3, 4))
+}
+
+func TestFIFOPolicy(t *testing.T) {
+	cache := NewCache[int, int]().Cap(3).Policy(NewFIFOPolicy[int]())
+	cache.Add(1, 1)
+	cache.Add(2, 2)
+	cache.Add(3, 3)
+	cache.Get(1)
+	cache.Add(4, 4)
+
+	assert.Equal(t, []int{2, 3, 4}, cachedKeys(cache, 1, 2, 3, 4), "Reads shouldn't affect FIFO order")
+}
+
+func TestLFUPolicy(t *testing.T) {
+	cache := NewCache[int, int]().Cap(3).Policy(NewLFUPolicy[int]())
+	cache.Add(1, 1)
+	cache.Add(2, 2)
+	cache.Add(3, 3)
+	cache.Get(1)
+	cache.Get(1)
+	cache.Get(2)
+	cache.Get(3)
+	cache.Get(3)
+
+	// 2 has the fewest reads
+	cache.Add(4, 4)
+	assert.Equal(t, []int{1, 3, 4}, cachedKeys(cache, 1, 2, 3, 4))
+
+	// 4 is new and least used; among equals the least recent goes
+	cache.Add(5, 5)
+	assert.Equal(t, []int{1, 3, 5}, cachedKeys(cache, 1, 2, 3, 4, 5))
+
+	cache.Remove(1)
+	cache.Add(6, 6)
+	cache.Add(7, 7)
+	assert.Equal(t, []int{3, 6, 7}, cachedKeys(cache, 1, 3, 5, 6, 7))
+}
+
+// splitmix64 is a fixed hash so that sketch collisions are the same every run.
+func splitmix64(k int) uint64 {
+	z := uint64(k) + 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func TestTinyLFUPolicy(t *testing.T) {
+	policy := NewTinyLFUPolicy[int](nil, 10)
+	policy.(*tinyLFUPolicy[int]).hash = splitmix64
+	cache := NewCache[int, int]().Cap(10).Policy(policy)
+
+	// Establish a hot working set
+	for i := 0; i < 10; i++ {
+		cache.Add(i, i)
+	}
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 10; i++ {
+			cache.Get(i)
+		}
+	}
+
+	// A scan of one-off keys must not flush the hot entries
+	for i := 100; i < 200; i++ {
+		cache.Add(i, i)
+	}
+	for i := 0; i < 10; i++ {
+		_, ok := cache.Get(i)
+		assert.True(t, ok, "Hot key %d should have survived the scan", i)
+	}
+	assert.Equal(t, uint64(100), cache.Stats().Evictions, "Scan keys should be rejected")
+
+	// A key requested often enough is eventually admitted
+	for n := 0; n < 3; n++ {
+		cache.Add(500, 500)
+	}
+	_, ok := cache.Get(500)
+	assert.True(t, ok, "Frequently added key should have been admitted")
+
+	// Updates to existing keys are never rejected
+	cache.Add(1, 42)
+	val, ok := cache.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, 42, val)
+}
+
+func TestTinyLFUPolicy_MaxCost(t *testing.T) {
+	policy := NewTinyLFUPolicy[int](nil, 10)
+	policy.(*tinyLFUPolicy[int]).hash = splitmix64
+	cache := NewCache[int, int]().
+		MaxCost(3).
+		Weigher(func(key, val int) int64 { return int64(val) }).
+		Policy(policy)
+
+	// 1 is cold, 2 and 3 are hot
+	cache.Add(1, 1)
+	cache.Add(2, 1)
+	cache.Add(3, 1)
+	for n := 0; n < 5; n++ {
+		cache.Get(2)
+		cache.Get(3)
+	}
+
+	// 100 is seen more often than 1, but would also displace 2
+	for n := 0; n < 3; n++ {
+		cache.Add(100, 2)
+	}
+	assert.Equal(t, []int{1, 2, 3}, cachedKeys(cache, 1, 2, 3, 100), "A rejected key must not evict anything")
+	assert.Equal(t, int64(3), cache.Stats().Cost)
+
+	// A key that only needs the cold entry's room is admitted
+	cache.Add(200, 1)
+	cache.Add(200, 1)
+	assert.Equal(t, []int{2, 3, 200}, cachedKeys(cache, 1, 2, 3, 200))
+}
+
+func TestRangeVictims(t *testing.T) {
+	for name, policy := range map[string]EvictionPolicy[int]{
+		"lru":     NewLRUPolicy[int](),
+		"fifo":    NewFIFOPolicy[int](),
+		"lfu":     NewLFUPolicy[int](),
+		"tinylfu": NewTinyLFUPolicy[int](NewLFUPolicy[int](), 10),
+	} {
+		for i := 0; i < 20; i++ {
+			policy.Added(i)
+		}
+		for i := 0; i < 50; i++ {
+			policy.Accessed((i * 7) % 20)
+		}
+
+		var ranged []int
+		policy.(VictimRanger[int]).RangeVictims(func(key int) bool {
+			ranged = append(ranged, key)
+			return true
+		})
+
+		// Ranging must match the order Victim gives, without changing it
+		var victims []int
+		for {
+			victim, ok := policy.Victim()
+			if !ok {
+				break
+			}
+			victims = append(victims, victim)
+			policy.Removed(victim)
+		}
+		assert.Len(t, victims, 20, name)
+		assert.Equal(t, victims, ranged, name)
+	}
+}
+
+func TestPolicy_ExistingEntries(t *testing.T) {
+	cache := NewCache[int, int]().Cap(3)
+	cache.Add(1, 1)
+	cache.Add(2, 2)
+	cache.Add(3, 3)
+	cache.Get(1)
+
+	// Switching policies keeps the entries' recency order
+	cache.Policy(NewFIFOPolicy[int]())
+	cache.Add(4, 4)
+	assert.Equal(t, []int{1, 3, 4}, cachedKeys(cache, 1, 2, 3, 4))
+}
+
+func TestCountMinSketch(t *testing.T) {
+	s := newCountMinSketch(100)
+	hash := newHasher[int]()
+
+	for i := 0; i < 5; i++ {
+		s.increment(hash(1))
+	}
+	s.increment(hash(2))
+
+	assert.Equal(t, uint8(5), s.estimate(hash(1)))
+	assert.Equal(t, uint8(1), s.estimate(hash(2)))
+	assert.Equal(t, uint8(0), s.estimate(hash(3)))
+
+	for i := 0; i < 100; i++ {
+		s.increment(hash(1))
+	}
+	assert.LessOrEqual(t, s.estimate(hash(1)), uint8(sketchMaxCounter))
+
+	s.age()
+	assert.Equal(t, uint8(0), s.estimate(hash(2)), "Aging should halve counters")
+}
@@ -0,0 +1,386 @@
+package mu
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"time"
+)
+
+// ShardedCache spreads keys across several independently locked Caches to
+// reduce lock contention. Capacity is split evenly across the shards, so
+// eviction order is only least-recently-used within a shard.
+type ShardedCache[K comparable, V any] struct {
+	shards []*Cache[K, V]
+	hash   func(K) uint64
+}
+
+func NewShardedCache[K comparable, V any](shards int) *ShardedCache[K, V] {
+	if shards < 1 {
+		shards = 1
+	}
+
+	c := &ShardedCache[K, V]{
+		shards: make([]*Cache[K, V], shards),
+		hash:   newHasher[K](),
+	}
+	for i := range c.shards {
+		c.shards[i] = NewCache[K, V]()
+	}
+	c.Cap(defaultCap)
+
+	return c
+}
+
+// Cap sets the total capacity, divided evenly (rounding up) across shards.
+func (c *ShardedCache[K, V]) Cap(cap int) *ShardedCache[K, V] {
+	perShard := (cap + len(c.shards) - 1) / len(c.shards)
+	for _, s := range c.shards {
+		s.Cap(perShard)
+	}
+	return c
+}
+
+// MaxCost sets the total cost budget, divided evenly (rounding up) across
+// shards.
+func (c *ShardedCache[K, V]) MaxCost(maxCost int64) *ShardedCache[K, V] {
+	n := int64(len(c.shards))
+	perShard := (maxCost + n - 1) / n
+	for _, s := range c.shards {
+		s.MaxCost(perShard)
+	}
+	return c
+}
+
+func (c *ShardedCache[K, V]) Weigher(weigher func(key K, val V) int64) *ShardedCache[K, V] {
+	for _, s := range c.shards {
+		s.Weigher(weigher)
+	}
+	return c
+}
+
+// Policy sets each shard's eviction policy to one returned by newPolicy.
+func (c *ShardedCache[K, V]) Policy(newPolicy func() EvictionPolicy[K]) *ShardedCache[K, V] {
+	for _, s := range c.shards {
+		s.Policy(newPolicy())
+	}
+	return c
+}
+
+func (c *ShardedCache[K, V]) TTL(ttl time.Duration) *ShardedCache[K, V] {
+	for _, s := range c.shards {
+		s.TTL(ttl)
+	}
+	return c
+}
+
+func (c *ShardedCache[K, V]) Jitter(max time.Duration) *ShardedCache[K, V] {
+	for _, s := range c.shards {
+		s.Jitter(max)
+	}
+	return c
+}
+
+func (c *ShardedCache[K, V]) JitterFraction(fraction float64) *ShardedCache[K, V] {
+	for _, s := range c.shards {
+		s.JitterFraction(fraction)
+	}
+	return c
+}
+
+func (c *ShardedCache[K, V]) KeepAlive(keepAlive bool) *ShardedCache[K, V] {
+	for _, s := range c.shards {
+		s.KeepAlive(keepAlive)
+	}
+	return c
+}
+
+func (c *ShardedCache[K, V]) NegativeTTL(ttl time.Duration) *ShardedCache[K, V] {
+	for _, s := range c.shards {
+		s.NegativeTTL(ttl)
+	}
+	return c
+}
+
+func (c *ShardedCache[K, V]) Clock(clock Clock) *ShardedCache[K, V] {
+	for _, s := range c.shards {
+		s.Clock(clock)
+	}
+	return c
+}
+
+func (c *ShardedCache[K, V]) OnEvict(fn func(key K, val V, reason EvictReason)) *ShardedCache[K, V] {
+	for _, s := range c.shards {
+		s.OnEvict(fn)
+	}
+	return c
+}
+
+// Hasher replaces the function used to pick a key's shard. The default
+// handles strings, integers and floats directly and falls back to formatting
+// the key with %v, which is slow, so other key types should usually supply
+// one. They must if equal keys can format differently, as with structs
+// holding floats (0.0 and -0.0 are equal) or pointers to mutable values.
+func (c *ShardedCache[K, V]) Hasher(hash func(K) uint64) *ShardedCache[K, V] {
+	c.hash = hash
+	return c
+}
+
+func (c *ShardedCache[K, V]) Janitor(interval time.Duration) *ShardedCache[K, V] {
+	for _, s := range c.shards {
+		s.Janitor(interval)
+	}
+	return c
+}
+
+func (c *ShardedCache[K, V]) Close() {
+	for _, s := range c.shards {
+		s.Close()
+	}
+}
+
+func (c *ShardedCache[K, V]) shard(key K) *Cache[K, V] {
+	return c.shards[c.hash(key)%uint64(len(c.shards))]
+}
+
+func (c *ShardedCache[K, V]) Add(key K, val V) {
+	c.shard(key).Add(key, val)
+}
+
+func (c *ShardedCache[K, V]) AddWithTTL(key K, val V, ttl time.Duration) {
+	c.shard(key).AddWithTTL(key, val, ttl)
+}
+
+func (c *ShardedCache[K, V]) Update(key K, fn func(old V, exists bool) (V, bool)) (V, bool) {
+	return c.shard(key).Update(key, fn)
+}
+
+func (c *ShardedCache[K, V]) AddIfAbsent(key K, val V) bool {
+	return c.shard(key).AddIfAbsent(key, val)
+}
+
+func (c *ShardedCache[K, V]) AddWithTags(key K, val V, tags ...string) {
+	c.shard(key).AddWithTags(key, val, tags...)
+}
+
+func (c *ShardedCache[K, V]) InvalidateTag(tag string) int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.InvalidateTag(tag)
+	}
+	return n
+}
+
+func (c *ShardedCache[K, V]) AddNegative(key K, err error) {
+	c.shard(key).AddNegative(key, err)
+}
+
+func (c *ShardedCache[K, V]) Lookup(key K) (V, bool, error) {
+	return c.shard(key).Lookup(key)
+}
+
+func (c *ShardedCache[K, V]) Get(key K) (V, bool) {
+	return c.shard(key).Get(key)
+}
+
+func (c *ShardedCache[K, V]) GetOrLoad(ctx context.Context, key K, load func(context.Context) (V, error)) (V, error) {
+	return c.shard(key).GetOrLoad(ctx, key, load)
+}
+
+func (c *ShardedCache[K, V]) Peek(key K) (V, bool) {
+	return c.shard(key).Peek(key)
+}
+
+func (c *ShardedCache[K, V]) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+func (c *ShardedCache[K, V]) Keys() []K {
+	var keys []K
+	for _, s := range c.shards {
+		keys = append(keys, s.Keys()...)
+	}
+	return keys
+}
+
+// Range calls fn for each unexpired entry until fn returns false, one shard at
+// a time.
+func (c *ShardedCache[K, V]) Range(fn func(key K, val V) bool) {
+	for _, s := range c.shards {
+		stopped := false
+		s.Range(func(key K, val V) bool {
+			if !fn(key, val) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// GetMany looks up several keys, taking each shard's lock once.
+func (c *ShardedCache[K, V]) GetMany(keys []K) (map[K]V, []K) {
+	hits := make(map[K]V, len(keys))
+	var misses []K
+	for shard, keys := range c.byShard(keys) {
+		h, m := shard.GetMany(keys)
+		for k, v := range h {
+			hits[k] = v
+		}
+		misses = append(misses, m...)
+	}
+	return hits, misses
+}
+
+func (c *ShardedCache[K, V]) AddMany(vals map[K]V) {
+	byShard := make(map[*Cache[K, V]]map[K]V)
+	for k, v := range vals {
+		s := c.shard(k)
+		if byShard[s] == nil {
+			byShard[s] = make(map[K]V)
+		}
+		byShard[s][k] = v
+	}
+	for shard, vals := range byShard {
+		shard.AddMany(vals)
+	}
+}
+
+// GetManyOrLoad is like Cache.GetManyOrLoad, loading the misses from all shards
+// with a single call to load.
+func (c *ShardedCache[K, V]) GetManyOrLoad(ctx context.Context, keys []K, load func(ctx context.Context, keys []K) (map[K]V, error)) (map[K]V, error) {
+	hits := make(map[K]V, len(keys))
+	var misses []K
+	batches := make(map[*Cache[K, V]]*batchLoad[K])
+	for shard, keys := range c.byShard(keys) {
+		shard.lock.Lock()
+		h, m, _ := shard.getMany(keys)
+		if b := shard.startBatch(m); b != nil {
+			batches[shard] = b
+		}
+		shard.unlock()
+
+		for k, v := range h {
+			hits[k] = v
+		}
+		misses = append(misses, m...)
+	}
+
+	if len(misses) == 0 {
+		return hits, nil
+	}
+
+	loaded, err := load(ctx, misses)
+
+	for shard, b := range batches {
+		shard.lock.Lock()
+		if err != nil {
+			delete(shard.batches, b)
+		} else {
+			shard.finishBatch(b, loaded, hits)
+		}
+		shard.unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return hits, nil
+}
+
+func (c *ShardedCache[K, V]) byShard(keys []K) map[*Cache[K, V]][]K {
+	byShard := make(map[*Cache[K, V]][]K)
+	for _, k := range keys {
+		s := c.shard(k)
+		byShard[s] = append(byShard[s], k)
+	}
+	return byShard
+}
+
+func (c *ShardedCache[K, V]) Remove(key K) {
+	c.shard(key).Remove(key)
+}
+
+func (c *ShardedCache[K, V]) Clear() {
+	for _, s := range c.shards {
+		s.Clear()
+	}
+}
+
+// Stats sums the statistics of all shards.
+func (c *ShardedCache[K, V]) Stats() CacheStats {
+	var total CacheStats
+	for _, s := range c.shards {
+		stats := s.Stats()
+		total.Hits += stats.Hits
+		total.Misses += stats.Misses
+		total.Expirations += stats.Expirations
+		total.Evictions += stats.Evictions
+		total.Size += stats.Size
+		total.Cost += stats.Cost
+	}
+	return total
+}
+
+func (c *ShardedCache[K, V]) ResetStats() {
+	for _, s := range c.shards {
+		s.ResetStats()
+	}
+}
+
+func newHasher[K comparable]() func(K) uint64 {
+	seed := maphash.MakeSeed()
+
+	return func(key K) uint64 {
+		var h maphash.Hash
+		h.SetSeed(seed)
+
+		switch k := any(key).(type) {
+		case string:
+			h.WriteString(k)
+		case int:
+			writeUint64(&h, uint64(k))
+		case int32:
+			writeUint64(&h, uint64(k))
+		case int64:
+			writeUint64(&h, uint64(k))
+		case uint:
+			writeUint64(&h, uint64(k))
+		case uint32:
+			writeUint64(&h, uint64(k))
+		case uint64:
+			writeUint64(&h, k)
+		case float32:
+			writeUint64(&h, math.Float64bits(normalizeZero(float64(k))))
+		case float64:
+			writeUint64(&h, math.Float64bits(normalizeZero(k)))
+		default:
+			fmt.Fprintf(&h, "%v", key)
+		}
+
+		return h.Sum64()
+	}
+}
+
+// normalizeZero turns -0 into 0, since they are equal keys but differ in bits.
+func normalizeZero(f float64) float64 {
+	if f == 0 {
+		return 0
+	}
+	return f
+}
+
+func writeUint64(h *maphash.Hash, v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	h.Write(buf[:])
+}
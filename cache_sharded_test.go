@@ -0,0 +1,121 @@
+package mu
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedCache(t *testing.T) {
+	cache := NewShardedCache[string, int](4)
+
+	cache.Add("key1", 1)
+	cache.Add("key2", 2)
+
+	val, ok := cache.Get("key1")
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+
+	assert.Equal(t, 2, cache.Len())
+	assert.ElementsMatch(t, []string{"key1", "key2"}, cache.Keys())
+	count := 0
+	cache.Range(func(key string, val int) bool {
+		count++
+		return false
+	})
+	assert.Equal(t, 1, count)
+
+	cache.Remove("key1")
+	_, ok = cache.Get("key1")
+	assert.False(t, ok, "Key 'key1' should have been removed")
+
+	cache.Clear()
+	_, ok = cache.Get("key2")
+	assert.False(t, ok, "Key 'key2' should have been cleared")
+}
+
+func TestShardedCache_Cap(t *testing.T) {
+	cache := NewShardedCache[int, int](4).Cap(10)
+	for _, s := range cache.shards {
+		assert.Equal(t, 3, s.cap, "Capacity should be split across shards, rounding up")
+	}
+
+	for i := 0; i < 1000; i++ {
+		cache.Add(i, i)
+	}
+	assert.LessOrEqual(t, cache.Stats().Size, 12)
+	assert.Equal(t, uint64(1000-cache.Stats().Size), cache.Stats().Evictions)
+}
+
+func TestShardedCache_Distribution(t *testing.T) {
+	cache := NewShardedCache[int, int](8).Cap(8000)
+	for i := 0; i < 8000; i++ {
+		cache.Add(i, i)
+	}
+
+	for _, s := range cache.shards {
+		n := s.Stats().Size
+		assert.True(t, n > 500 && n < 1500, "Shard size %d is badly unbalanced", n)
+	}
+}
+
+func TestShardedCache_FloatKeys(t *testing.T) {
+	cache := NewShardedCache[float64, string](64)
+	negZero := math.Copysign(0, -1)
+
+	// 0 and -0 are the same key, so they must land in the same shard
+	cache.Add(0, "zero")
+	val, ok := cache.Get(negZero)
+	assert.True(t, ok)
+	assert.Equal(t, "zero", val)
+	assert.Equal(t, cache.hash(0), cache.hash(negZero))
+
+	small := NewShardedCache[float32, int](64)
+	small.Add(float32(negZero), 1)
+	_, ok = small.Get(0)
+	assert.True(t, ok)
+}
+
+func TestShardedCache_Options(t *testing.T) {
+	clock := &Time{}
+	cache := NewShardedCache[string, int](2).
+		Clock(clock).
+		TTL(time.Minute).
+		Hasher(func(string) uint64 { return 1 })
+
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+	assert.Equal(t, 0, cache.shards[0].Stats().Size)
+	assert.Equal(t, 2, cache.shards[1].Stats().Size)
+
+	clock.Advance(2 * time.Minute)
+	_, ok := cache.Get("a")
+	assert.False(t, ok, "Entry should have expired")
+	assert.Equal(t, CacheStats{Misses: 1, Expirations: 1, Size: 1, Cost: 1}, cache.Stats())
+}
+
+func TestShardedCache_Batch(t *testing.T) {
+	cache := NewShardedCache[int, int](4)
+	cache.AddMany(map[int]int{1: 10, 2: 20, 3: 30})
+
+	hits, misses := cache.GetMany([]int{1, 2, 3, 4})
+	assert.Equal(t, map[int]int{1: 10, 2: 20, 3: 30}, hits)
+	assert.Equal(t, []int{4}, misses)
+
+	calls := 0
+	vals, err := cache.GetManyOrLoad(context.Background(), []int{1, 4, 5, 6}, func(ctx context.Context, keys []int) (map[int]int, error) {
+		calls++
+		assert.ElementsMatch(t, []int{4, 5, 6}, keys)
+		return map[int]int{4: 40, 5: 50, 6: 60}, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]int{1: 10, 4: 40, 5: 50, 6: 60}, vals)
+	assert.Equal(t, 1, calls)
+
+	val, ok := cache.Get(6)
+	assert.True(t, ok)
+	assert.Equal(t, 60, val)
+}
@@ -1,6 +1,11 @@
 package mu
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -23,10 +28,11 @@ func TestExpLRU_Add(t *testing.T) {
 }
 
 func TestExpLRU_Get_Expired(t *testing.T) {
-	cache := NewCache[string, int]().TTL(time.Millisecond)
+	clock := &Time{}
+	cache := NewCache[string, int]().Clock(clock).TTL(time.Millisecond)
 	cache.Add("key", 42)
 
-	time.Sleep(2 * time.Millisecond)
+	clock.Advance(2 * time.Millisecond)
 
 	_, ok := cache.Get("key")
 	assert.False(t, ok, "Should not retrieve expired value")
@@ -40,7 +46,8 @@ func TestExpLRU_Get_NotFound(t *testing.T) {
 }
 
 func TestExpLRU_Eviction(t *testing.T) {
-	cache := NewCache[int, int]().Cap(10).TTL(100 * time.Millisecond)
+	clock := &Time{}
+	cache := NewCache[int, int]().Clock(clock).Cap(10).TTL(100 * time.Millisecond)
 
 	// Fill cache
 	for i := 0; i < 10; i++ {
@@ -48,20 +55,79 @@ func TestExpLRU_Eviction(t *testing.T) {
 	}
 	assert.Equal(t, 10, len(cache.cache))
 
-	// Check that adding one more results in 0.5 + 1 cache size
+	// Check that adding one more evicts only a single entry
 	cache.Add(40, 40)
-	assert.Equal(t, 6, len(cache.cache))
-
-	// Fill cache
-	for i := 0; i < 4; i++ {
-		cache.Add(i+100, i)
-	}
 	assert.Equal(t, 10, len(cache.cache))
+	_, ok := cache.Get(0)
+	assert.False(t, ok, "Least recently used entry should have been evicted")
 
-	// Wait, add 1, and check the all of the expired values are gone
-	time.Sleep(200 * time.Millisecond)
+	// Wait and add 1. All expired values should be reclaimed
+	clock.Advance(200 * time.Millisecond)
 	cache.Add(500, 500)
 	assert.Equal(t, 1, len(cache.cache))
+	assert.Equal(t, []int{500}, cache.Keys())
+}
+
+func TestExpLRU_EvictionPrefersExpired(t *testing.T) {
+	clock := &Time{}
+	cache := NewCache[int, int]().Clock(clock).Cap(40).TTL(time.Minute).KeepAlive(true)
+	for i := 0; i < 20; i++ {
+		cache.Add(i, i)
+		cache.AddWithTTL(100+i, i, time.Second)
+	}
+	for i := 0; i < 20; i++ {
+		cache.Get(100 + i)
+	}
+
+	// Every expired entry goes before the least recently used live one
+	clock.Advance(2 * time.Second)
+	cache.Add(300, 300)
+	assert.Equal(t, 21, len(cache.cache))
+	_, ok := cache.Get(0)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(20), cache.Stats().Expirations)
+	assert.Equal(t, uint64(0), cache.Stats().Evictions)
+
+	// Entries that never expire stay out of the heap
+	cache.AddWithTTL(400, 400, NoExpiration)
+	assert.Len(t, cache.expiry, 21)
+
+	// Reads that extend an entry move it back in the heap
+	clock.Advance(30 * time.Second)
+	cache.Get(0)
+	clock.Advance(40 * time.Second)
+	cache.purgeExpired()
+	assert.ElementsMatch(t, []int{0, 400}, cache.Keys())
+	assert.Len(t, cache.expiry, 1)
+}
+
+func TestExpLRU_EvictionOrder(t *testing.T) {
+	cache := NewCache[int, int]().Cap(3)
+
+	cache.Add(1, 1)
+	cache.Add(2, 2)
+	cache.Add(3, 3)
+
+	// Touch 1 so that 2 becomes the least recently used
+	cache.Get(1)
+	cache.Add(4, 4)
+
+	_, ok := cache.Get(2)
+	assert.False(t, ok, "Key 2 should have been evicted")
+	for _, k := range []int{1, 3, 4} {
+		_, ok := cache.Get(k)
+		assert.True(t, ok, "Key %d should still be in the cache", k)
+	}
+
+	// Updating an existing key also counts as a use, and doesn't evict
+	cache.Add(1, 10)
+	cache.Add(5, 5)
+	assert.Equal(t, 3, len(cache.cache))
+	_, ok = cache.Get(3)
+	assert.False(t, ok, "Key 3 should have been evicted")
+	val, ok := cache.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, 10, val)
 }
 
 func TestExpLRU_Concurrent(t *testing.T) {
@@ -94,7 +160,8 @@ func TestExpLRU_Concurrent(t *testing.T) {
 func TestKeepAlive(t *testing.T) {
 	// Test with KeepAlive set to false (default behavior)
 	t.Run("KeepAlive false", func(t *testing.T) {
-		cache := NewCache[string, int]().
+		clock := &Time{}
+		cache := NewCache[string, int]().Clock(clock).
 			TTL(100 * time.Millisecond)
 
 		cache.Add("key", 42)
@@ -105,7 +172,7 @@ func TestKeepAlive(t *testing.T) {
 		assert.Equal(t, 42, val, "Expected to get 42")
 
 		// Wait for half the TTL
-		time.Sleep(50 * time.Millisecond)
+		clock.Advance(50 * time.Millisecond)
 
 		// Second get should still succeed
 		val, ok = cache.Get("key")
@@ -113,7 +180,7 @@ func TestKeepAlive(t *testing.T) {
 		assert.Equal(t, 42, val, "Expected to get 42")
 
 		// Wait for the TTL to expire
-		time.Sleep(60 * time.Millisecond)
+		clock.Advance(60 * time.Millisecond)
 
 		// Third get should fail
 		_, ok = cache.Get("key")
@@ -122,7 +189,8 @@ func TestKeepAlive(t *testing.T) {
 
 	// Test with KeepAlive set to true
 	t.Run("KeepAlive true", func(t *testing.T) {
-		cache := NewCache[string, int]().
+		clock := &Time{}
+		cache := NewCache[string, int]().Clock(clock).
 			TTL(100 * time.Millisecond).
 			KeepAlive(true)
 
@@ -134,7 +202,7 @@ func TestKeepAlive(t *testing.T) {
 		assert.Equal(t, 42, val, "Expected to get 42")
 
 		// Wait for half the TTL
-		time.Sleep(50 * time.Millisecond)
+		clock.Advance(50 * time.Millisecond)
 
 		// Second get should succeed and reset the expiration
 		val, ok = cache.Get("key")
@@ -142,7 +210,7 @@ func TestKeepAlive(t *testing.T) {
 		assert.Equal(t, 42, val, "Expected to get 42")
 
 		// Wait for the original TTL to expire
-		time.Sleep(60 * time.Millisecond)
+		clock.Advance(60 * time.Millisecond)
 
 		// Third get should still succeed because the expiration was reset
 		val, ok = cache.Get("key")
@@ -150,7 +218,7 @@ func TestKeepAlive(t *testing.T) {
 		assert.Equal(t, 42, val, "Expected to get 42")
 
 		// Wait for the TTL to expire again
-		time.Sleep(110 * time.Millisecond)
+		clock.Advance(110 * time.Millisecond)
 
 		// Fourth get should fail
 		_, ok = cache.Get("key")
@@ -231,3 +299,1023 @@ func TestExpLRU_RemoveAndAdd(t *testing.T) {
 	assert.True(t, ok, "Key should be present after removing and re-adding")
 	assert.Equal(t, 2, val, "New value should be retrieved after removing and re-adding")
 }
+
+func TestGetOrLoad(t *testing.T) {
+	t.Run("hit and miss", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		cache.Add("cached", 1)
+
+		calls := 0
+		load := func(ctx context.Context) (int, error) {
+			calls++
+			return 42, nil
+		}
+
+		val, err := cache.GetOrLoad(context.Background(), "cached", load)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, val)
+		assert.Equal(t, 0, calls, "Loader should not run on a hit")
+
+		val, err = cache.GetOrLoad(context.Background(), "key", load)
+		assert.NoError(t, err)
+		assert.Equal(t, 42, val)
+		assert.Equal(t, 1, calls)
+
+		val, ok := cache.Get("key")
+		assert.True(t, ok, "Loaded value should be cached")
+		assert.Equal(t, 42, val)
+	})
+
+	t.Run("coalescing", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		var calls atomic.Int32
+		release := make(chan struct{})
+
+		load := func(ctx context.Context) (int, error) {
+			calls.Add(1)
+			<-release
+			return 42, nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				val, err := cache.GetOrLoad(context.Background(), "key", load)
+				assert.NoError(t, err)
+				assert.Equal(t, 42, val)
+			}()
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), calls.Load(), "Loader should only run once")
+	})
+
+	t.Run("errors are not cached", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		loadErr := errors.New("backend down")
+
+		_, err := cache.GetOrLoad(context.Background(), "key", func(ctx context.Context) (int, error) {
+			return 0, loadErr
+		})
+		assert.Equal(t, loadErr, err)
+
+		_, ok := cache.Get("key")
+		assert.False(t, ok, "Failed load should not be cached")
+
+		val, err := cache.GetOrLoad(context.Background(), "key", func(ctx context.Context) (int, error) {
+			return 7, nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 7, val)
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		loadCanceled := make(chan struct{})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+
+		_, err := cache.GetOrLoad(ctx, "key", func(ctx context.Context) (int, error) {
+			<-ctx.Done()
+			close(loadCanceled)
+			return 0, ctx.Err()
+		})
+		assert.Equal(t, context.Canceled, err)
+
+		select {
+		case <-loadCanceled:
+		case <-time.After(time.Second):
+			t.Fatal("Loader context should be cancelled once all callers are gone")
+		}
+	})
+
+	t.Run("context already done", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		cache.Add("cached", 1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		calls := 0
+		load := func(ctx context.Context) (int, error) {
+			calls++
+			return 42, nil
+		}
+
+		_, err := cache.GetOrLoad(ctx, "key", load)
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, 0, calls, "No load should start for a caller that has gone")
+		_, ok := cache.Get("key")
+		assert.False(t, ok)
+
+		val, err := cache.GetOrLoad(ctx, "cached", load)
+		assert.NoError(t, err, "Hits are returned regardless of ctx")
+		assert.Equal(t, 1, val)
+	})
+}
+
+func TestOnEvict(t *testing.T) {
+	clock := &Time{}
+	type evicted struct {
+		key    string
+		val    int
+		reason EvictReason
+	}
+	var got []evicted
+	cache := NewCache[string, int]().Clock(clock).
+		Cap(2).
+		TTL(50 * time.Millisecond)
+	cache.OnEvict(func(key string, val int, reason EvictReason) {
+		// Callbacks run outside the lock, so using the cache must not deadlock
+		cache.Get(key)
+		got = append(got, evicted{key, val, reason})
+	})
+
+	cache.Add("a", 1)
+	cache.Add("a", 2)
+	assert.Equal(t, []evicted{{"a", 1, EvictReplaced}}, got)
+
+	got = nil
+	cache.Add("b", 3)
+	cache.Add("c", 4)
+	assert.Equal(t, []evicted{{"a", 2, EvictCapacity}}, got)
+
+	got = nil
+	cache.Remove("b")
+	cache.Remove("missing")
+	assert.Equal(t, []evicted{{"b", 3, EvictRemoved}}, got)
+
+	got = nil
+	clock.Advance(60 * time.Millisecond)
+	cache.Get("c")
+	assert.Equal(t, []evicted{{"c", 4, EvictExpired}}, got)
+
+	got = nil
+	cache.Add("d", 5)
+	cache.Clear()
+	assert.Equal(t, []evicted{{"d", 5, EvictCleared}}, got)
+}
+
+func TestEvictReasonString(t *testing.T) {
+	assert.Equal(t, "capacity", EvictCapacity.String())
+	assert.Equal(t, "replaced", EvictReplaced.String())
+	assert.Equal(t, "unknown", EvictReason(99).String())
+}
+
+func TestStats(t *testing.T) {
+	clock := &Time{}
+	cache := NewCache[int, int]().Clock(clock).Cap(2).TTL(50 * time.Millisecond)
+
+	cache.Add(1, 1)
+	cache.Add(2, 2)
+	cache.Get(1)
+	cache.Get(1)
+	cache.Get(3)
+	cache.Add(3, 3)
+
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 1, Evictions: 1, Size: 2, Cost: 2}, cache.Stats())
+
+	clock.Advance(60 * time.Millisecond)
+	cache.Get(1)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 2, Expirations: 1, Evictions: 1, Size: 1, Cost: 1}, cache.Stats())
+
+	cache.ResetStats()
+	assert.Equal(t, CacheStats{Size: 1, Cost: 1}, cache.Stats())
+}
+
+func TestJanitor(t *testing.T) {
+	cache := NewCache[int, int]().
+		TTL(20 * time.Millisecond).
+		Janitor(10 * time.Millisecond)
+	defer cache.Close()
+
+	for i := 0; i < 10; i++ {
+		cache.Add(i, i)
+	}
+	assert.Equal(t, 10, cache.Stats().Size)
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, 0, cache.Stats().Size, "Janitor should have removed expired entries")
+	assert.Equal(t, uint64(10), cache.Stats().Expirations)
+
+	// Close is idempotent and the cache is still usable afterwards
+	cache.Close()
+	cache.Close()
+	cache.Add(1, 1)
+	val, ok := cache.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+}
+
+func TestJanitor_NoInterval(t *testing.T) {
+	cache := NewCache[int, int]().Janitor(0)
+	assert.Nil(t, cache.stopSweep)
+
+	cache.Janitor(time.Minute)
+	assert.NotNil(t, cache.stopSweep)
+	cache.Janitor(-time.Second)
+	assert.Nil(t, cache.stopSweep)
+
+	sharded := NewShardedCache[int, int](2).Janitor(0)
+	for _, s := range sharded.shards {
+		assert.Nil(t, s.stopSweep)
+	}
+}
+
+func TestJanitor_Concurrent(t *testing.T) {
+	cache := NewShardedCache[int, int](4).Janitor(time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			cache.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			cache.Janitor(time.Millisecond)
+		}()
+	}
+	wg.Wait()
+
+	cache.Close()
+	for _, s := range cache.shards {
+		assert.Nil(t, s.stopSweep)
+	}
+}
+
+func TestAddWithTTL(t *testing.T) {
+	clock := &Time{}
+	t.Run("per-entry TTL", func(t *testing.T) {
+		cache := NewCache[string, int]().Clock(clock).TTL(time.Hour)
+
+		cache.AddWithTTL("short", 1, 20*time.Millisecond)
+		cache.Add("default", 2)
+		cache.AddWithTTL("forever", 3, NoExpiration)
+
+		clock.Advance(30 * time.Millisecond)
+
+		_, ok := cache.Get("short")
+		assert.False(t, ok, "Entry with short TTL should have expired")
+		_, ok = cache.Get("default")
+		assert.True(t, ok, "Entry with default TTL should still be present")
+		_, ok = cache.Get("forever")
+		assert.True(t, ok, "Entry without expiration should still be present")
+	})
+
+	t.Run("never expire", func(t *testing.T) {
+		cache := NewCache[string, int]().Clock(clock).TTL(time.Millisecond)
+		cache.AddWithTTL("forever", 1, NoExpiration)
+		cache.Add("default", 2)
+
+		clock.Advance(5 * time.Millisecond)
+		cache.purgeExpired()
+
+		_, ok := cache.Get("forever")
+		assert.True(t, ok)
+		_, ok = cache.Get("default")
+		assert.False(t, ok)
+	})
+
+	t.Run("keep alive uses entry TTL", func(t *testing.T) {
+		cache := NewCache[string, int]().Clock(clock).
+			TTL(time.Hour).
+			KeepAlive(true)
+		cache.AddWithTTL("key", 1, 40*time.Millisecond)
+
+		clock.Advance(25 * time.Millisecond)
+		_, ok := cache.Get("key")
+		assert.True(t, ok)
+
+		clock.Advance(25 * time.Millisecond)
+		_, ok = cache.Get("key")
+		assert.True(t, ok, "Read should have extended the entry by its own TTL")
+
+		clock.Advance(50 * time.Millisecond)
+		_, ok = cache.Get("key")
+		assert.False(t, ok)
+	})
+}
+
+// waitForLoads waits until no loads or refreshes are in flight.
+func waitForLoads[K comparable, V any](t *testing.T, cache *Cache[K, V]) {
+	for i := 0; i < 1000; i++ {
+		cache.lock.Lock()
+		n := len(cache.calls)
+		cache.lock.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for loads to finish")
+}
+
+func TestRefreshAfter(t *testing.T) {
+	clock := &Time{}
+	var refreshes atomic.Int32
+	fail := atomic.Bool{}
+
+	cache := NewCache[string, int]().
+		Clock(clock).
+		TTL(time.Minute).
+		RefreshAfter(10*time.Second, func(ctx context.Context, key string) (int, error) {
+			if fail.Load() {
+				return 0, errors.New("refresh failed")
+			}
+			return int(refreshes.Add(1)) * 100, nil
+		})
+
+	cache.Add("key", 1)
+
+	// Fresh entries don't trigger a refresh
+	val, ok := cache.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+	waitForLoads(t, cache)
+	assert.Equal(t, int32(0), refreshes.Load())
+
+	// Stale entries are served while the refresh happens in the background
+	clock.Advance(15 * time.Second)
+	val, ok = cache.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, 1, val, "Stale value should be returned")
+	waitForLoads(t, cache)
+
+	val, ok = cache.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, 100, val, "Refreshed value should be returned")
+
+	// A failed refresh keeps the stale value
+	fail.Store(true)
+	clock.Advance(15 * time.Second)
+	val, _ = cache.Get("key")
+	assert.Equal(t, 100, val)
+	waitForLoads(t, cache)
+	val, ok = cache.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, 100, val, "Stale value should be kept after a failed refresh")
+	waitForLoads(t, cache)
+
+	// Past the hard TTL the entry is a miss
+	clock.Advance(2 * time.Minute)
+	_, ok = cache.Get("key")
+	assert.False(t, ok, "Entries past the TTL should not be served")
+}
+
+func TestRefreshAfter_Coalesced(t *testing.T) {
+	clock := &Time{}
+	var refreshes atomic.Int32
+	release := make(chan struct{})
+
+	cache := NewCache[string, int]().
+		Clock(clock).
+		RefreshAfter(time.Second, func(ctx context.Context, key string) (int, error) {
+			refreshes.Add(1)
+			<-release
+			return 2, nil
+		})
+
+	cache.Add("key", 1)
+	clock.Advance(2 * time.Second)
+	for i := 0; i < 10; i++ {
+		val, _ := cache.Get("key")
+		assert.Equal(t, 1, val)
+	}
+	close(release)
+	waitForLoads(t, cache)
+
+	val, _ := cache.Get("key")
+	assert.Equal(t, 2, val)
+	assert.Equal(t, int32(1), refreshes.Load(), "Only one refresh should run per key")
+}
+
+func TestMaxCost(t *testing.T) {
+	var evicted []string
+	cache := NewCache[string, []byte]().
+		Cap(1).
+		MaxCost(10).
+		Weigher(func(key string, val []byte) int64 { return int64(len(val)) }).
+		OnEvict(func(key string, val []byte, reason EvictReason) {
+			evicted = append(evicted, key+":"+reason.String())
+		})
+
+	cache.Add("a", make([]byte, 4))
+	cache.Add("b", make([]byte, 4))
+	assert.Equal(t, 2, cache.Stats().Size, "Cap should be ignored when MaxCost is set")
+	assert.Equal(t, int64(8), cache.Stats().Cost)
+
+	// Needs 5 more, so the least recently used entry goes
+	cache.Get("a")
+	cache.Add("c", make([]byte, 5))
+	assert.Equal(t, []string{"b:capacity"}, evicted)
+	assert.Equal(t, int64(9), cache.Stats().Cost)
+
+	// Replacing an entry updates its cost
+	evicted = nil
+	cache.Add("c", make([]byte, 1))
+	assert.Equal(t, []string{"c:replaced"}, evicted)
+	assert.Equal(t, int64(5), cache.Stats().Cost)
+
+	// Entries larger than the whole budget are rejected
+	evicted = nil
+	cache.Add("huge", make([]byte, 11))
+	assert.Equal(t, []string{"huge:capacity"}, evicted)
+	_, ok := cache.Get("huge")
+	assert.False(t, ok)
+	assert.Equal(t, 2, cache.Stats().Size)
+
+	cache.Remove("a")
+	assert.Equal(t, int64(1), cache.Stats().Cost)
+	cache.Clear()
+	assert.Equal(t, int64(0), cache.Stats().Cost)
+}
+
+func TestInspection(t *testing.T) {
+	clock := &Time{}
+	cache := NewCache[string, int]().Clock(clock).TTL(time.Minute)
+
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+	cache.AddWithTTL("short", 3, time.Second)
+	clock.Advance(2 * time.Second)
+
+	assert.Equal(t, 2, cache.Len(), "Len should skip expired entries")
+	assert.ElementsMatch(t, []string{"a", "b"}, cache.Keys())
+
+	seen := map[string]int{}
+	cache.Range(func(key string, val int) bool {
+		seen[key] = val
+		// Using the cache from within Range must not deadlock
+		cache.Peek(key)
+		return true
+	})
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, seen)
+
+	count := 0
+	cache.Range(func(key string, val int) bool {
+		count++
+		return false
+	})
+	assert.Equal(t, 1, count, "Range should stop when fn returns false")
+
+	_, ok := cache.Peek("short")
+	assert.False(t, ok, "Peek should not return expired entries")
+}
+
+func TestPeek(t *testing.T) {
+	clock := &Time{}
+	cache := NewCache[string, int]().
+		Clock(clock).
+		Cap(2).
+		TTL(time.Minute).
+		KeepAlive(true)
+
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+
+	clock.Advance(40 * time.Second)
+	val, ok := cache.Peek("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+	assert.Equal(t, CacheStats{Size: 2, Cost: 2}, cache.Stats(), "Peek should not affect stats")
+
+	// Peek doesn't count as a use, so "a" is still least recently used
+	cache.Add("c", 3)
+	_, ok = cache.Peek("a")
+	assert.False(t, ok, "Key 'a' should have been evicted")
+
+	// Peek doesn't extend expiration
+	clock.Advance(30 * time.Second)
+	_, ok = cache.Peek("b")
+	assert.False(t, ok, "Key 'b' should have expired")
+}
+
+func TestUpdate(t *testing.T) {
+	clock := &Time{}
+	cache := NewCache[string, int]().Clock(clock).TTL(time.Minute)
+	incr := func(old int, exists bool) (int, bool) {
+		return old + 1, true
+	}
+
+	val, ok := cache.Update("counter", incr)
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.Update("counter", incr)
+		}()
+	}
+	wg.Wait()
+
+	val, _ = cache.Get("counter")
+	assert.Equal(t, 101, val, "Concurrent updates should not be lost")
+
+	// Returning false removes the entry
+	_, ok = cache.Update("counter", func(old int, exists bool) (int, bool) {
+		assert.True(t, exists)
+		return 0, false
+	})
+	assert.False(t, ok)
+	_, ok = cache.Get("counter")
+	assert.False(t, ok, "Entry should have been removed")
+
+	// Expired entries are treated as absent and updates keep the entry's TTL
+	cache.AddWithTTL("short", 5, time.Second)
+	clock.Advance(2 * time.Second)
+	val, _ = cache.Update("short", func(old int, exists bool) (int, bool) {
+		assert.False(t, exists)
+		assert.Equal(t, 0, old)
+		return 10, true
+	})
+	assert.Equal(t, 10, val)
+
+	cache.AddWithTTL("short", 1, time.Second)
+	cache.Update("short", incr)
+	clock.Advance(2 * time.Second)
+	_, ok = cache.Get("short")
+	assert.False(t, ok, "Updated entry should keep its own TTL")
+}
+
+func TestAddIfAbsent(t *testing.T) {
+	clock := &Time{}
+	cache := NewCache[string, int]().Clock(clock).TTL(time.Minute)
+
+	assert.True(t, cache.AddIfAbsent("key", 1))
+	assert.False(t, cache.AddIfAbsent("key", 2))
+	val, _ := cache.Get("key")
+	assert.Equal(t, 1, val)
+
+	clock.Advance(2 * time.Minute)
+	assert.True(t, cache.AddIfAbsent("key", 3), "Expired entries should count as absent")
+	val, _ = cache.Get("key")
+	assert.Equal(t, 3, val)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	cache := NewCache[string, int]()
+
+	assert.False(t, CompareAndSwap(cache, "key", 0, 1), "Missing keys should not be swapped")
+	_, ok := cache.Get("key")
+	assert.False(t, ok)
+
+	cache.Add("key", 1)
+	assert.False(t, CompareAndSwap(cache, "key", 2, 3))
+	assert.True(t, CompareAndSwap(cache, "key", 1, 3))
+	val, _ := cache.Get("key")
+	assert.Equal(t, 3, val)
+}
+
+func TestNegativeEntries(t *testing.T) {
+	clock := &Time{}
+	var evicted []string
+	cache := NewCache[string, int]().
+		Clock(clock).
+		TTL(time.Minute).
+		NegativeTTL(time.Second).
+		OnEvict(func(key string, val int, reason EvictReason) {
+			evicted = append(evicted, key)
+		})
+
+	cache.AddNegative("missing", nil)
+	backendErr := errors.New("backend down")
+	cache.AddNegative("failed", backendErr)
+
+	_, ok := cache.Get("missing")
+	assert.False(t, ok, "Get should treat negative entries as absent")
+	_, ok = cache.Peek("missing")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Len())
+	assert.Empty(t, cache.Keys())
+
+	_, ok, err := cache.Lookup("missing")
+	assert.True(t, ok)
+	assert.Equal(t, ErrNotFound, err)
+	_, ok, err = cache.Lookup("failed")
+	assert.True(t, ok)
+	assert.Equal(t, backendErr, err)
+	_, ok, err = cache.Lookup("uncached")
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	// GetOrLoad returns the cached error without loading
+	_, err = cache.GetOrLoad(context.Background(), "failed", func(ctx context.Context) (int, error) {
+		t.Fatal("Loader should not be called for a negative entry")
+		return 0, nil
+	})
+	assert.Equal(t, backendErr, err)
+
+	// Negative entries use their own TTL
+	clock.Advance(2 * time.Second)
+	_, ok, _ = cache.Lookup("missing")
+	assert.False(t, ok, "Negative entry should have expired")
+
+	// Adding a value replaces a negative entry
+	cache.AddNegative("key", nil)
+	assert.True(t, cache.AddIfAbsent("key", 1), "Negative entries should count as absent")
+	val, ok, err := cache.Lookup("key")
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, val)
+
+	assert.Empty(t, evicted, "Negative entries have no value to evict")
+}
+
+func TestGetOrLoad_NegativeTTL(t *testing.T) {
+	clock := &Time{}
+	loadErr := errors.New("not found upstream")
+	calls := 0
+	load := func(ctx context.Context) (int, error) {
+		calls++
+		return 0, loadErr
+	}
+
+	cache := NewCache[string, int]().Clock(clock).NegativeTTL(time.Second)
+
+	_, err := cache.GetOrLoad(context.Background(), "key", load)
+	assert.Equal(t, loadErr, err)
+	_, err = cache.GetOrLoad(context.Background(), "key", load)
+	assert.Equal(t, loadErr, err)
+	assert.Equal(t, 1, calls, "Failure should have been cached")
+
+	clock.Advance(2 * time.Second)
+	_, err = cache.GetOrLoad(context.Background(), "key", load)
+	assert.Equal(t, loadErr, err)
+	assert.Equal(t, 2, calls, "Cached failure should have expired")
+
+	// Context errors are never cached
+	cache.Clear()
+	_, err = cache.GetOrLoad(context.Background(), "ctx", func(ctx context.Context) (int, error) {
+		return 0, context.DeadlineExceeded
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	_, ok, _ := cache.Lookup("ctx")
+	assert.False(t, ok)
+}
+
+func TestGetOrLoad_Panic(t *testing.T) {
+	cache := NewCache[string, int]().NegativeTTL(time.Minute)
+	release := make(chan struct{})
+	load := func(ctx context.Context) (int, error) {
+		<-release
+		panic("boom")
+	}
+
+	// Every caller sharing the load sees the panic
+	var wg sync.WaitGroup
+	panics := make(chan any, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { panics <- recover() }()
+			cache.GetOrLoad(context.Background(), "key", load)
+		}()
+	}
+	for {
+		cache.lock.Lock()
+		cl := cache.calls["key"]
+		n := 0
+		if cl != nil {
+			n = cl.waiters
+		}
+		cache.lock.Unlock()
+		if n == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	close(panics)
+	for p := range panics {
+		assert.Equal(t, "boom", p)
+	}
+
+	// Nothing is cached, and the key can be loaded again
+	_, ok, _ := cache.Lookup("key")
+	assert.False(t, ok)
+	val, err := cache.GetOrLoad(context.Background(), "key", func(ctx context.Context) (int, error) {
+		return 1, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, val)
+
+	// A panicking refresh doesn't crash the process
+	clock := &Time{}
+	refreshing := NewCache[string, int]().Clock(clock).
+		RefreshAfter(time.Second, func(ctx context.Context, key string) (int, error) {
+			panic("boom")
+		})
+	refreshing.Add("key", 1)
+	clock.Advance(2 * time.Second)
+	refreshing.Get("key")
+	waitForLoads(t, refreshing)
+	val, ok = refreshing.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+}
+
+func TestInvalidateTag(t *testing.T) {
+	var removed []string
+	cache := NewCache[string, int]().
+		OnEvict(func(key string, val int, reason EvictReason) {
+			if reason == EvictRemoved {
+				removed = append(removed, key)
+			}
+		})
+
+	cache.AddWithTags("profile:1", 1, "user:1")
+	cache.AddWithTags("perms:1", 2, "user:1", "perms")
+	cache.AddWithTags("perms:2", 3, "user:2", "perms")
+	cache.Add("other", 4)
+
+	assert.Equal(t, 2, cache.InvalidateTag("user:1"))
+	assert.ElementsMatch(t, []string{"profile:1", "perms:1"}, removed)
+	assert.ElementsMatch(t, []string{"perms:2", "other"}, cache.Keys())
+
+	assert.Equal(t, 0, cache.InvalidateTag("user:1"))
+	assert.Equal(t, 0, cache.InvalidateTag("unknown"))
+
+	// Replacing an entry drops its tags
+	cache.Add("perms:2", 5)
+	assert.Equal(t, 0, cache.InvalidateTag("perms"))
+	assert.Empty(t, cache.tags, "Tag index should be cleaned up")
+
+	// Removed entries leave the tag index
+	cache.AddWithTags("a", 1, "t")
+	cache.Remove("a")
+	assert.Empty(t, cache.tags)
+
+	// Changing the caller's slice afterwards doesn't affect the index
+	tags := []string{"u1"}
+	cache.AddWithTags("k", 1, tags...)
+	tags[0] = "other"
+	cache.Remove("k")
+	assert.Equal(t, 0, cache.InvalidateTag("u1"))
+	assert.Empty(t, cache.tags)
+}
+
+func TestInvalidateTag_Replacements(t *testing.T) {
+	clock := &Time{}
+	var version atomic.Int32
+	cache := NewCache[string, int]().
+		Clock(clock).
+		TTL(time.Hour).
+		RefreshAfter(time.Minute, func(ctx context.Context, key string) (int, error) {
+			return int(version.Load()), nil
+		})
+
+	cache.AddWithTags("perms:1", 0, "user:1")
+	version.Store(1)
+	clock.Advance(2 * time.Minute)
+	cache.Get("perms:1")
+	waitForLoads(t, cache)
+	val, _ := cache.Peek("perms:1")
+	assert.Equal(t, 1, val, "Entry should have been refreshed")
+
+	cache.Update("perms:1", func(old int, exists bool) (int, bool) { return old + 1, true })
+	CompareAndSwap(cache, "perms:1", 2, 3)
+	val, _ = cache.Peek("perms:1")
+	assert.Equal(t, 3, val)
+
+	assert.Equal(t, 1, cache.InvalidateTag("user:1"), "Tags should survive refresh, Update and CompareAndSwap")
+	_, ok := cache.Get("perms:1")
+	assert.False(t, ok)
+}
+
+func TestInvalidate_InFlight(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slowLoad := func(ctx context.Context) (int, error) {
+		close(started)
+		<-release
+		return 1, nil
+	}
+
+	t.Run("Remove during GetOrLoad", func(t *testing.T) {
+		cache := NewCache[string, int]()
+		started, release = make(chan struct{}), make(chan struct{})
+		done := make(chan int)
+		go func() {
+			val, _ := cache.GetOrLoad(context.Background(), "key", slowLoad)
+			done <- val
+		}()
+
+		<-started
+		cache.Remove("key")
+		close(release)
+		assert.Equal(t, 1, <-done, "Waiting callers still get the loaded value")
+
+		_, ok := cache.Get("key")
+		assert.False(t, ok, "A load overtaken by Remove must not be cached")
+	})
+
+	t.Run("InvalidateTag during refresh", func(t *testing.T) {
+		clock := &Time{}
+		cache := NewCache[string, int]().
+			Clock(clock).
+			RefreshAfter(time.Minute, func(ctx context.Context, key string) (int, error) {
+				return slowLoad(ctx)
+			})
+		started, release = make(chan struct{}), make(chan struct{})
+
+		cache.AddWithTags("key", 0, "tag")
+		clock.Advance(2 * time.Minute)
+		cache.Get("key")
+
+		<-started
+		cache.lock.Lock()
+		cl := cache.calls["key"]
+		cache.lock.Unlock()
+
+		assert.Equal(t, 1, cache.InvalidateTag("tag"))
+		close(release)
+		<-cl.done
+
+		_, ok := cache.Get("key")
+		assert.False(t, ok, "A refresh overtaken by InvalidateTag must not be cached")
+	})
+}
+
+func TestInvalidatePrefix(t *testing.T) {
+	cache := NewCache[string, int]()
+	cache.Add("user:1:profile", 1)
+	cache.Add("user:1:perms", 2)
+	cache.Add("user:10:profile", 3)
+	cache.Add("user:2:profile", 4)
+
+	assert.Equal(t, 2, InvalidatePrefix(cache, "user:1:"))
+	assert.ElementsMatch(t, []string{"user:10:profile", "user:2:profile"}, cache.Keys())
+}
+
+func TestJitter(t *testing.T) {
+	expirations := func(cache *Cache[int, int]) map[time.Time]bool {
+		seen := map[time.Time]bool{}
+		for _, ent := range cache.cache {
+			seen[ent.expiration] = true
+		}
+		return seen
+	}
+
+	t.Run("max duration", func(t *testing.T) {
+		clock := &Time{}
+		clock.Set(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+		cache := NewCache[int, int]().
+			Clock(clock).
+			TTL(time.Hour).
+			Jitter(time.Minute)
+
+		for i := 0; i < 50; i++ {
+			cache.Add(i, i)
+		}
+
+		assert.Greater(t, len(expirations(cache)), 1, "Expirations should be spread out")
+		for exp := range expirations(cache) {
+			assert.True(t, !exp.After(clock.Now().Add(time.Hour)))
+			assert.True(t, exp.After(clock.Now().Add(time.Hour-time.Minute)))
+		}
+	})
+
+	t.Run("fraction", func(t *testing.T) {
+		clock := &Time{}
+		clock.Set(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+		cache := NewCache[int, int]().
+			Clock(clock).
+			TTL(time.Hour).
+			JitterFraction(0.1)
+
+		for i := 0; i < 50; i++ {
+			cache.Add(i, i)
+		}
+
+		assert.Greater(t, len(expirations(cache)), 1, "Expirations should be spread out")
+		for exp := range expirations(cache) {
+			assert.True(t, exp.After(clock.Now().Add(54*time.Minute)))
+		}
+	})
+
+	t.Run("max caps fraction", func(t *testing.T) {
+		cache := NewCache[int, int]().Jitter(time.Second).JitterFraction(0.5)
+		for i := 0; i < 100; i++ {
+			assert.Less(t, int64(cache.jitterFor(time.Hour)), int64(time.Second))
+		}
+		assert.Equal(t, time.Duration(0), cache.jitterFor(NoExpiration))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		clock := &Time{}
+		clock.Set(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+		cache := NewCache[int, int]().Clock(clock)
+		for i := 0; i < 10; i++ {
+			cache.Add(i, i)
+		}
+		assert.Len(t, expirations(cache), 1)
+	})
+}
+
+func TestGetMany(t *testing.T) {
+	cache := NewCache[int, string]()
+	cache.AddMany(map[int]string{1: "one", 2: "two", 3: "three"})
+	cache.AddNegative(4, nil)
+
+	hits, misses := cache.GetMany([]int{1, 3, 4, 5, 1, 5})
+	assert.Equal(t, map[int]string{1: "one", 3: "three"}, hits)
+	assert.Equal(t, []int{5, 4}, misses)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+}
+
+func TestGetManyOrLoad_Invalidation(t *testing.T) {
+	loadThen := func(invalidate func()) func(ctx context.Context, keys []string) (map[string]int, error) {
+		return func(ctx context.Context, keys []string) (map[string]int, error) {
+			invalidate()
+			return map[string]int{"a": 1, "b": 2, "user:c": 3}, nil
+		}
+	}
+	keys := []string{"a", "b", "user:c", "missing"}
+
+	for name, tc := range map[string]struct {
+		invalidate func(cache *Cache[string, int])
+		cached     []string
+	}{
+		"Clear":            {func(c *Cache[string, int]) { c.Clear() }, nil},
+		"Remove":           {func(c *Cache[string, int]) { c.Remove("a") }, []string{"b", "user:c"}},
+		"InvalidatePrefix": {func(c *Cache[string, int]) { InvalidatePrefix(c, "user:") }, []string{"a", "b"}},
+		"InvalidateTag":    {func(c *Cache[string, int]) { c.InvalidateTag("t") }, []string{"a", "b", "user:c"}},
+	} {
+		cache := NewCache[string, int]().NegativeTTL(time.Minute)
+		vals, err := cache.GetManyOrLoad(context.Background(), keys, loadThen(func() { tc.invalidate(cache) }))
+		assert.NoError(t, err, name)
+		assert.Equal(t, map[string]int{"a": 1, "b": 2, "user:c": 3}, vals, "Callers still get the loaded values (%s)", name)
+		assert.ElementsMatch(t, tc.cached, cache.Keys(), name)
+		assert.Empty(t, cache.batches)
+
+		// Negative entries for invalidated keys aren't stored either
+		_, ok, _ := cache.Lookup("missing")
+		assert.Equal(t, name != "Clear", ok, name)
+	}
+
+	sharded := NewShardedCache[string, int](4)
+	_, err := sharded.GetManyOrLoad(context.Background(), keys, loadThen(func() { sharded.Clear() }))
+	assert.NoError(t, err)
+	assert.Empty(t, sharded.Keys(), "A sharded batch overtaken by Clear must not be cached")
+	_, err = sharded.GetManyOrLoad(context.Background(), keys, loadThen(func() { sharded.Remove("b") }))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "user:c"}, sharded.Keys())
+}
+
+func TestGetManyOrLoad(t *testing.T) {
+	cache := NewCache[int, string]().NegativeTTL(time.Minute)
+	cache.Add(1, "one")
+
+	var requested [][]int
+	load := func(ctx context.Context, keys []int) (map[int]string, error) {
+		requested = append(requested, keys)
+		vals := map[int]string{}
+		for _, k := range keys {
+			if k < 10 {
+				vals[k] = fmt.Sprint("#", k)
+			}
+		}
+		return vals, nil
+	}
+
+	vals, err := cache.GetManyOrLoad(context.Background(), []int{1, 2, 3, 10}, load)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]string{1: "one", 2: "#2", 3: "#3"}, vals)
+	assert.Equal(t, [][]int{{2, 3, 10}}, requested, "Misses should be loaded in one batch")
+
+	// Loaded values are cached, and keys the loader didn't return are negative
+	vals, err = cache.GetManyOrLoad(context.Background(), []int{2, 3, 10}, load)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]string{2: "#2", 3: "#3"}, vals)
+	assert.Len(t, requested, 1)
+	_, ok, err := cache.Lookup(10)
+	assert.True(t, ok)
+	assert.Equal(t, ErrNotFound, err)
+
+	loadErr := errors.New("backend down")
+	_, err = cache.GetManyOrLoad(context.Background(), []int{4}, func(ctx context.Context, keys []int) (map[int]string, error) {
+		return nil, loadErr
+	})
+	assert.Equal(t, loadErr, err)
+	_, ok, _ = cache.Lookup(4)
+	assert.False(t, ok, "Batch errors should not be cached")
+}
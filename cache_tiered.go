@@ -0,0 +1,306 @@
+package mu
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store is a slower, usually larger, secondary storage tier for a
+// TieredCache.
+type Store[K comparable, V any] interface {
+	Get(key K) (val V, ok bool, err error)
+	Set(key K, val V) error
+	Delete(key K) error
+}
+
+// TieredCache puts an in-memory Cache in front of a Store. Reads check memory
+// first and promote values found in the store. Writes go to both tiers
+// immediately (write-through) by default, or with WriteBack only to memory,
+// reaching the store when the entry leaves memory or on Flush.
+//
+// A Store has no expiry of its own. When an entry expires in memory it is also
+// deleted from the store, but an entry evicted from memory to make room stays
+// in the store, without a TTL, until it is removed or read back and left to
+// expire.
+type TieredCache[K comparable, V any] struct {
+	mem   *Cache[K, V]
+	store Store[K, V]
+
+	lock         sync.Mutex
+	writeBack    bool
+	dirty        map[K]dirtyValue[V] // values written to memory but not yet to the store
+	seq          uint64              // source of dirtyValue versions
+	adding       map[K]int           // Adds in progress, whose values supersede an expired one
+	onWriteError func(key K, err error)
+
+	// writeLock is held while writing a dirty value to the store, or deleting
+	// from it, so that a slow write can't overwrite a newer value or undo a
+	// Remove. c.lock isn't held during store I/O.
+	writeLock sync.Mutex
+}
+
+// dirtyValue is a write-back value waiting to be written to the store. Each
+// Add gets a new version, so a write only marks the key clean if no newer
+// value arrived meanwhile.
+type dirtyValue[V any] struct {
+	val     V
+	version uint64
+}
+
+// NewTieredCache creates a tiered cache from mem, configured as usual, and
+// store. It takes over mem's OnEvict callback, chaining to any already set, so
+// mem shouldn't be used directly afterwards.
+func NewTieredCache[K comparable, V any](mem *Cache[K, V], store Store[K, V]) *TieredCache[K, V] {
+	c := &TieredCache[K, V]{
+		mem:    mem,
+		store:  store,
+		dirty:  make(map[K]dirtyValue[V]),
+		adding: make(map[K]int),
+	}
+
+	prev := mem.onEvict
+	mem.OnEvict(func(key K, val V, reason EvictReason) {
+		c.evicted(key, reason)
+		if prev != nil {
+			prev(key, val, reason)
+		}
+	})
+
+	return c
+}
+
+// WriteBack delays writes to the store until an entry is evicted from memory
+// or Flush is called.
+func (c *TieredCache[K, V]) WriteBack(writeBack bool) *TieredCache[K, V] {
+	c.writeBack = writeBack
+	return c
+}
+
+// OnWriteError sets a function to receive errors from write-back writes to the
+// store that happen on eviction, where there is no caller to return them to.
+func (c *TieredCache[K, V]) OnWriteError(fn func(key K, err error)) *TieredCache[K, V] {
+	c.onWriteError = fn
+	return c
+}
+
+// Get returns the value from memory, or from the store if it isn't in memory,
+// in which case it is added to memory.
+func (c *TieredCache[K, V]) Get(key K) (V, bool, error) {
+	if val, ok := c.mem.Get(key); ok {
+		return val, true, nil
+	}
+
+	// A value that left memory but couldn't be written yet is newer than the
+	// store's
+	c.lock.Lock()
+	d, ok := c.dirty[key]
+	c.lock.Unlock()
+	if ok {
+		c.mem.AddIfAbsent(key, d.val)
+		return d.val, true, nil
+	}
+
+	val, ok, err := c.store.Get(key)
+	if err != nil || !ok {
+		return val, false, err
+	}
+	c.mem.AddIfAbsent(key, val)
+
+	return val, true, nil
+}
+
+func (c *TieredCache[K, V]) Add(key K, val V) error {
+	c.lock.Lock()
+	c.adding[key]++
+	if c.writeBack {
+		// Marked dirty first, so that an eviction straight after mem.Add
+		// still writes the value to the store
+		c.seq++
+		c.dirty[key] = dirtyValue[V]{val: val, version: c.seq}
+	}
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		if c.adding[key]--; c.adding[key] == 0 {
+			delete(c.adding, key)
+		}
+		c.lock.Unlock()
+	}()
+
+	if !c.writeBack {
+		if err := c.store.Set(key, val); err != nil {
+			return err
+		}
+	}
+	c.mem.Add(key, val)
+
+	return nil
+}
+
+// Remove deletes key from both tiers.
+func (c *TieredCache[K, V]) Remove(key K) error {
+	c.lock.Lock()
+	delete(c.dirty, key)
+	c.lock.Unlock()
+
+	c.mem.Remove(key)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.store.Delete(key)
+}
+
+// Flush writes all pending write-back entries to the store.
+func (c *TieredCache[K, V]) Flush() error {
+	c.lock.Lock()
+	keys := make([]K, 0, len(c.dirty))
+	for key := range c.dirty {
+		keys = append(keys, key)
+	}
+	c.lock.Unlock()
+
+	var errs []error
+	for _, key := range keys {
+		if err := c.writeDirty(key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// evicted writes a dirty entry to the store as it leaves memory, or deletes
+// it from the store if it expired.
+func (c *TieredCache[K, V]) evicted(key K, reason EvictReason) {
+	var err error
+	switch reason {
+	case EvictReplaced, EvictRemoved:
+		return
+	case EvictExpired:
+		err = c.expire(key)
+	default:
+		err = c.writeDirty(key)
+	}
+
+	if err != nil && c.onWriteError != nil {
+		c.onWriteError(key, err)
+	}
+}
+
+// expire deletes an expired key from the store, unless a newer value has been
+// added since.
+func (c *TieredCache[K, V]) expire(key K) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.lock.Lock()
+	if c.adding[key] > 0 {
+		c.lock.Unlock()
+		return nil
+	}
+	if _, ok := c.mem.Peek(key); ok {
+		c.lock.Unlock()
+		return nil
+	}
+	delete(c.dirty, key)
+	c.lock.Unlock()
+
+	return c.store.Delete(key)
+}
+
+// writeDirty writes the latest pending value for key, if any, to the store.
+func (c *TieredCache[K, V]) writeDirty(key K) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.lock.Lock()
+	d, ok := c.dirty[key]
+	c.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if err := c.store.Set(key, d.val); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	if c.dirty[key].version == d.version {
+		delete(c.dirty, key)
+	}
+	c.lock.Unlock()
+
+	return nil
+}
+
+// FileStore is a Store that keeps each value gob-encoded in its own file in a
+// directory.
+type FileStore[V any] struct {
+	dir string
+}
+
+// NewFileStore returns a store that uses dir, creating it if necessary.
+func NewFileStore[V any](dir string) (*FileStore[V], error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore[V]{dir: dir}, nil
+}
+
+// path maps a key to a file name. Keys are hashed so that any string is safe
+// to use.
+func (s *FileStore[V]) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *FileStore[V]) Get(key string) (val V, ok bool, err error) {
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return val, false, nil
+	}
+	if err != nil {
+		return val, false, err
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(&val); err != nil {
+		return val, false, err
+	}
+	return val, true, nil
+}
+
+// Set writes the value to a temporary file and renames it into place, so
+// readers never see a partial value.
+func (s *FileStore[V]) Set(key string, val V) error {
+	f, err := os.CreateTemp(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := gob.NewEncoder(f).Encode(val); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path(key))
+}
+
+func (s *FileStore[V]) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
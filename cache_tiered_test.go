@@ -0,0 +1,284 @@
+package mu
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mapStore is an in-memory Store that records how it is used.
+type mapStore struct {
+	lock    sync.Mutex
+	data    map[string]int
+	sets    int
+	gets    int
+	failed  bool
+	setting chan struct{} // if set, Set signals on it and then waits for it
+}
+
+func newMapStore() *mapStore {
+	return &mapStore{data: map[string]int{}}
+}
+
+func (s *mapStore) Get(key string) (int, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gets++
+	val, ok := s.data[key]
+	return val, ok, nil
+}
+
+func (s *mapStore) Set(key string, val int) error {
+	if s.setting != nil {
+		s.setting <- struct{}{}
+		<-s.setting
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.failed {
+		return errors.New("store unavailable")
+	}
+	s.sets++
+	s.data[key] = val
+	return nil
+}
+
+func (s *mapStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.data, key)
+	return nil
+}
+
+func TestTieredCache_WriteThrough(t *testing.T) {
+	store := newMapStore()
+	cache := NewTieredCache[string, int](NewCache[string, int]().Cap(2), store)
+
+	assert.NoError(t, cache.Add("a", 1))
+	assert.Equal(t, 1, store.data["a"], "Writes should go straight to the store")
+
+	val, ok, err := cache.Get("a")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+	assert.Equal(t, 0, store.gets, "Memory hits should not reach the store")
+
+	// Push "a" out of memory, then read it back from the store
+	cache.Add("b", 2)
+	cache.Add("c", 3)
+	val, ok, err = cache.Get("a")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, val)
+	assert.Equal(t, 1, store.gets)
+
+	// ...which promotes it back into memory
+	cache.Get("a")
+	assert.Equal(t, 1, store.gets)
+
+	_, ok, err = cache.Get("missing")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, cache.Remove("a"))
+	_, ok, _ = cache.Get("a")
+	assert.False(t, ok, "Remove should delete from both tiers")
+
+	store.failed = true
+	assert.Error(t, cache.Add("d", 4))
+	_, ok, _ = cache.Get("d")
+	assert.False(t, ok, "Failed writes should not be cached")
+}
+
+func TestTieredCache_WriteBack(t *testing.T) {
+	store := newMapStore()
+	var evicted []string
+	mem := NewCache[string, int]().
+		Cap(2).
+		OnEvict(func(key string, val int, reason EvictReason) {
+			evicted = append(evicted, key)
+		})
+	cache := NewTieredCache[string, int](mem, store).WriteBack(true)
+
+	cache.Add("a", 1)
+	cache.Add("a", 2)
+	cache.Add("b", 3)
+	assert.Empty(t, store.data, "Writes should stay in memory")
+
+	// Evicting a dirty entry writes it to the store
+	cache.Add("c", 4)
+	assert.Equal(t, map[string]int{"a": 2}, store.data)
+	assert.Equal(t, []string{"a", "a"}, evicted, "Existing OnEvict should still be called")
+
+	assert.NoError(t, cache.Flush())
+	assert.Equal(t, map[string]int{"a": 2, "b": 3, "c": 4}, store.data)
+
+	// Clean entries aren't written again
+	sets := store.sets
+	cache.Flush()
+	cache.Add("d", 5)
+	assert.Equal(t, sets, store.sets)
+
+	// Write errors on eviction are reported
+	var writeErr error
+	cache.OnWriteError(func(key string, err error) { writeErr = err })
+	store.failed = true
+	cache.Add("e", 6)
+	cache.Add("f", 7)
+	assert.Error(t, writeErr)
+	assert.Error(t, cache.Flush())
+}
+
+func TestTieredCache_WriteBackConcurrent(t *testing.T) {
+	store := newMapStore()
+	cache := NewTieredCache[string, int](NewCache[string, int]().Cap(4), store).WriteBack(true)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for i := 1; i <= 500; i++ {
+				cache.Add("key"+strconv.Itoa(g), i)
+			}
+		}(g)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				cache.Flush()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The last value written must reach the store, whatever Flush saw
+	assert.NoError(t, cache.Flush())
+	for g := 0; g < 4; g++ {
+		assert.Equal(t, 500, store.data["key"+strconv.Itoa(g)])
+	}
+}
+
+func TestTieredCache_FlushDoesNotBlock(t *testing.T) {
+	store := newMapStore()
+	cache := NewTieredCache[string, int](NewCache[string, int](), store).WriteBack(true)
+	cache.Add("a", 1)
+
+	store.setting = make(chan struct{})
+	flushed := make(chan error)
+	go func() { flushed <- cache.Flush() }()
+	<-store.setting
+
+	// While the store write is in progress, other keys can still be used
+	cache.Add("b", 2)
+	val, ok, err := cache.Get("b")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, val)
+
+	// A newer value for the key being written keeps it dirty
+	cache.Add("a", 3)
+
+	store.setting <- struct{}{}
+	store.setting = nil
+	assert.NoError(t, <-flushed)
+	assert.Equal(t, 1, store.data["a"])
+
+	assert.NoError(t, cache.Flush())
+	assert.Equal(t, map[string]int{"a": 3, "b": 2}, store.data)
+}
+
+func TestTieredCache_UnwrittenValues(t *testing.T) {
+	store := newMapStore()
+	store.data["a"] = 1
+	cache := NewTieredCache[string, int](NewCache[string, int]().Cap(1), store).WriteBack(true)
+
+	// "a" can't be written back when evicted, but is still readable
+	store.failed = true
+	cache.Add("a", 2)
+	cache.Add("b", 3)
+	val, ok, err := cache.Get("a")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, val, "The unwritten value is newer than the store's")
+
+	store.failed = false
+	assert.NoError(t, cache.Flush())
+	assert.Equal(t, 2, store.data["a"])
+}
+
+func TestTieredCache_Expiry(t *testing.T) {
+	for _, writeBack := range []bool{false, true} {
+		clock := &Time{}
+		store := newMapStore()
+		mem := NewCache[string, int]().Clock(clock).TTL(time.Second)
+		cache := NewTieredCache[string, int](mem, store).WriteBack(writeBack)
+
+		cache.Add("a", 1)
+		cache.Add("b", 2)
+		clock.Advance(time.Hour)
+
+		_, ok, err := cache.Get("a")
+		assert.NoError(t, err)
+		assert.False(t, ok, "Expired entries shouldn't be served from the store (write-back %v)", writeBack)
+		assert.NotContains(t, store.data, "a")
+
+		// Expiring in memory doesn't write the value to the store
+		mem.lock.Lock()
+		mem.purgeExpired()
+		mem.unlock()
+		assert.NoError(t, cache.Flush())
+		assert.Empty(t, store.data, "write-back %v", writeBack)
+
+		// A value added after expiry is kept
+		cache.Add("a", 3)
+		val, ok, _ := cache.Get("a")
+		assert.True(t, ok)
+		assert.Equal(t, 3, val)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	store, err := NewFileStore[[]string](t.TempDir())
+	assert.NoError(t, err)
+
+	_, ok, err := store.Get("missing")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, store.Set("../odd/key", []string{"a", "b"}))
+	val, ok, err := store.Get("../odd/key")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a", "b"}, val)
+
+	assert.NoError(t, store.Set("../odd/key", []string{"c"}))
+	val, _, _ = store.Get("../odd/key")
+	assert.Equal(t, []string{"c"}, val)
+
+	assert.NoError(t, store.Delete("../odd/key"))
+	assert.NoError(t, store.Delete("../odd/key"))
+	_, ok, _ = store.Get("../odd/key")
+	assert.False(t, ok)
+}
+
+func TestTieredCache_FileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore[int](dir)
+	assert.NoError(t, err)
+
+	cache := NewTieredCache[string, int](NewCache[string, int](), store)
+	assert.NoError(t, cache.Add("key", 42))
+
+	// A new cache over the same directory sees the value
+	store2, _ := NewFileStore[int](dir)
+	cache2 := NewTieredCache[string, int](NewCache[string, int](), store2)
+	val, ok, err := cache2.Get("key")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 42, val)
+}
@@ -1,8 +1,11 @@
 package mu
 
 import (
+	"bytes"
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 
 	"github.com/dchest/uniuri"
@@ -55,10 +58,84 @@ func DeriveKey(password string, salt []byte, customParams ...Argon2Params) ([]by
 	return key, salt
 }
 
+// Encrypted data is wrapped in a versioned envelope so that the algorithm can
+// change without breaking stored data:
+//
+//	magic "mu\xe5" | version | algorithm | key ID length | key ID | payload
+//
+// For AlgSecretbox the payload is a 24 byte nonce followed by a secretbox
+// sealing the header and the data, so the header can't be altered either.
+// Data from before the envelope existed is a bare nonce and secretbox, and is
+// treated as version 0.
+var envelopeMagic = []byte("mu\xe5")
+
+const (
+	envelopeVersion    = 1
+	envelopeHeaderSize = 6 // magic, version, algorithm and key ID length
+)
+
+// Algorithm identifies the cipher used for an envelope's payload.
+type Algorithm uint8
+
+const (
+	AlgSecretbox Algorithm = 1 // NaCl secretbox: XSalsa20 and Poly1305
+)
+
+var errDecrypt = errors.New("decryption failure")
+
+// Envelope is the parsed header of encrypted data.
+type Envelope struct {
+	Version   uint8
+	Algorithm Algorithm
+	KeyID     string // identifies the key, if one was given when encrypting
+
+	header  []byte
+	payload []byte
+}
+
+// ParseEnvelope reads the header of data from Encrypt, for instance to select
+// a key by KeyID before decrypting. Data without the magic bytes is reported
+// as version 0.
+func ParseEnvelope(data []byte) (*Envelope, error) {
+	if len(data) < envelopeHeaderSize || !bytes.Equal(data[:len(envelopeMagic)], envelopeMagic) {
+		return &Envelope{Version: 0, Algorithm: AlgSecretbox, payload: data}, nil
+	}
+	if data[3] != envelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", data[3])
+	}
+
+	alg := Algorithm(data[4])
+	if alg != AlgSecretbox {
+		return nil, fmt.Errorf("unknown encryption algorithm %d", alg)
+	}
+
+	end := envelopeHeaderSize + int(data[5])
+	if len(data) < end {
+		return nil, errDecrypt
+	}
+
+	return &Envelope{
+		Version:   envelopeVersion,
+		Algorithm: alg,
+		KeyID:     string(data[envelopeHeaderSize:end]),
+		header:    data[:end],
+		payload:   data[end:],
+	}, nil
+}
+
 func Encrypt(data, key []byte) []byte {
+	return EncryptWithKeyID(data, key, "")
+}
+
+// EncryptWithKeyID is like Encrypt but records keyID, which may be up to 255
+// bytes, in the envelope. It isn't secret, but is authenticated.
+func EncryptWithKeyID(data, key []byte, keyID string) []byte {
 	if len(key) != 32 {
 		panic("invalid key length")
 	}
+	if len(keyID) > 255 {
+		panic("key ID too long")
+	}
 
 	var secretKey [32]byte
 	var nonce [24]byte
@@ -66,7 +143,12 @@ func Encrypt(data, key []byte) []byte {
 	copy(secretKey[:], key)
 	copy(nonce[:], RandBytes(24))
 
-	return secretbox.Seal(nonce[:], []byte(data), &nonce, &secretKey)
+	header := append([]byte{}, envelopeMagic...)
+	header = append(header, envelopeVersion, byte(AlgSecretbox), byte(len(keyID)))
+	header = append(header, keyID...)
+
+	out := append(header, nonce[:]...)
+	return secretbox.Seal(out, append(header[:len(header):len(header)], data...), &nonce, &secretKey)
 }
 
 func Decrypt(data, key []byte) ([]byte, error) {
@@ -74,15 +156,138 @@ func Decrypt(data, key []byte) ([]byte, error) {
 		panic("invalid key length")
 	}
 
+	env, err := ParseEnvelope(data)
+	if err == nil && env.Version == 0 {
+		return openSecretbox(data, key)
+	}
+	if err == nil {
+		decrypted, openErr := openSecretbox(env.payload, key)
+		if openErr == nil && bytes.HasPrefix(decrypted, env.header) {
+			return decrypted[len(env.header):], nil
+		}
+		err = errDecrypt
+	}
+
+	// Version 0 data could start with the magic bytes by chance
+	if decrypted, v0Err := openSecretbox(data, key); v0Err == nil {
+		return decrypted, nil
+	}
+	return nil, err
+}
+
+// Password-encrypted data starts with the key derivation parameters, followed
+// by the output of Encrypt with the derived key:
+//
+//	magic "mu\xe6" | version | time | memory | threads | key length | salt length | salt | envelope
+//
+// with time, memory and key length as big-endian uint32s. Changing any of
+// them changes the key, so they don't need separate authentication.
+var passwordMagic = []byte("mu\xe6")
+
+const (
+	passwordVersion    = 1
+	passwordHeaderSize = 18
+)
+
+// MaxArgon2Params are the most expensive parameters DecryptWithPassword
+// accepts by default. Parameters are read from the data before it can be
+// authenticated, so without a limit a crafted input could make key derivation
+// exhaust memory or CPU. These allow a few times the cost of
+// DefaultArgon2Params.
+var MaxArgon2Params = Argon2Params{
+	Time:    80,
+	Memory:  16 * 1024,
+	Threads: 4,
+	KeyLen:  32,
+}
+
+// EncryptWithPassword encrypts data with a key derived from password, using
+// DefaultArgon2Params unless customParams are given. The salt and parameters
+// are stored in the output, so DecryptWithPassword needs only the password.
+// It panics if the parameters' KeyLen isn't 32 or they exceed
+// MaxArgon2Params, since the result couldn't be decrypted by default.
+func EncryptWithPassword(data []byte, password string, customParams ...Argon2Params) []byte {
+	params := DefaultArgon2Params
+	if len(customParams) > 0 {
+		params = customParams[0]
+	}
+	if params.KeyLen != 32 {
+		panic("invalid key length")
+	}
+	if !validArgon2Params(params, MaxArgon2Params) {
+		panic("invalid Argon2 parameters")
+	}
+
+	key, salt := DeriveKey(password, nil, params)
+
+	out := append([]byte{}, passwordMagic...)
+	out = append(out, passwordVersion)
+	out = binary.BigEndian.AppendUint32(out, params.Time)
+	out = binary.BigEndian.AppendUint32(out, params.Memory)
+	out = append(out, params.Threads)
+	out = binary.BigEndian.AppendUint32(out, params.KeyLen)
+	out = append(out, byte(len(salt)))
+	out = append(out, salt...)
+
+	return append(out, Encrypt(data, key)...)
+}
+
+// DecryptWithPassword decrypts data from EncryptWithPassword. It rejects data
+// whose key derivation parameters exceed maxParams, or MaxArgon2Params if
+// none are given, before doing any expensive work.
+func DecryptWithPassword(data []byte, password string, maxParams ...Argon2Params) ([]byte, error) {
+	limits := MaxArgon2Params
+	if len(maxParams) > 0 {
+		limits = maxParams[0]
+	}
+
+	if len(data) < passwordHeaderSize || !bytes.Equal(data[:len(passwordMagic)], passwordMagic) {
+		return nil, errors.New("not password-encrypted data")
+	}
+	if data[3] != passwordVersion {
+		return nil, fmt.Errorf("unknown password encryption version %d", data[3])
+	}
+
+	params := Argon2Params{
+		Time:    binary.BigEndian.Uint32(data[4:]),
+		Memory:  binary.BigEndian.Uint32(data[8:]),
+		Threads: data[12],
+		KeyLen:  binary.BigEndian.Uint32(data[13:]),
+	}
+	if params.KeyLen != 32 || !validArgon2Params(params, limits) {
+		return nil, errors.New("invalid Argon2 parameters")
+	}
+
+	saltEnd := passwordHeaderSize + int(data[17])
+	if len(data) < saltEnd {
+		return nil, errDecrypt
+	}
+
+	key, _ := DeriveKey(password, data[passwordHeaderSize:saltEnd], params)
+	return Decrypt(data[saltEnd:], key)
+}
+
+func validArgon2Params(p, limits Argon2Params) bool {
+	return p.Time > 0 && p.Time <= limits.Time &&
+		p.Memory > 0 && p.Memory <= limits.Memory &&
+		p.Threads > 0 && p.Threads <= limits.Threads
+}
+
+// openSecretbox opens a nonce followed by a secretbox.
+func openSecretbox(data, key []byte) ([]byte, error) {
+	if len(data) < 24 {
+		return nil, errDecrypt
+	}
+
 	var secretKey [32]byte
 	var nonce [24]byte
 
 	copy(secretKey[:], key)
-
 	copy(nonce[:], data[:24])
+
 	decrypted, ok := secretbox.Open(nil, data[24:], &nonce, &secretKey)
 	if !ok {
-		return nil, errors.New("decryption failure")
+		return nil, errDecrypt
 	}
 
 	return decrypted, nil
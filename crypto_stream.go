@@ -0,0 +1,219 @@
+package mu
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// An encrypted stream is a header followed by chunks, each a secretbox of up
+// to streamChunkSize bytes of plaintext:
+//
+//	magic "mu\xe7" | version | 15 byte random nonce prefix | chunk...
+//
+// Every chunk but the last holds exactly streamChunkSize bytes. A chunk's
+// nonce is the stream's prefix, the chunk's index as a big-endian uint64 and a
+// byte that is 1 for the last chunk, so chunks can't be reordered, dropped or
+// moved between streams, and a truncated stream fails to authenticate.
+var streamMagic = []byte("mu\xe7")
+
+const (
+	streamVersion    = 1
+	streamPrefixSize = 15
+	streamHeaderSize = 4 + streamPrefixSize
+	streamChunkSize  = 64 * 1024
+)
+
+var errStreamClosed = errors.New("write to closed encrypt writer")
+
+type streamNonce struct {
+	prefix [streamPrefixSize]byte
+	index  uint64
+}
+
+func (n *streamNonce) next(final bool) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], n.prefix[:])
+	binary.BigEndian.PutUint64(nonce[streamPrefixSize:], n.index)
+	if final {
+		nonce[23] = 1
+	}
+	n.index++
+	return &nonce
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	key    [32]byte
+	nonce  streamNonce
+	buf    []byte
+	out    []byte
+	header bool // whether the header has been written
+	closed bool
+	err    error
+}
+
+// NewEncryptWriter returns a writer that encrypts data with key, which must be
+// 32 bytes, and writes it to w in authenticated chunks, so that data of any
+// size can be encrypted in constant memory. Close must be called to write the
+// final chunk; it doesn't close w. The result is read with NewDecryptReader.
+func NewEncryptWriter(w io.Writer, key []byte) io.WriteCloser {
+	if len(key) != 32 {
+		panic("invalid key length")
+	}
+
+	e := &encryptWriter{
+		w:   w,
+		buf: make([]byte, 0, streamChunkSize),
+	}
+	copy(e.key[:], key)
+	copy(e.nonce.prefix[:], RandBytes(streamPrefixSize))
+
+	return e
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errStreamClosed
+	}
+
+	n := 0
+	for len(p) > 0 && e.err == nil {
+		// A full chunk is only written once more data arrives, since the last
+		// chunk must be marked as final.
+		if len(e.buf) == streamChunkSize {
+			e.flush(false)
+			continue
+		}
+
+		c := copy(e.buf[len(e.buf):streamChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+
+	return n, e.err
+}
+
+// Close writes any buffered data as the final chunk.
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return e.err
+	}
+	e.closed = true
+	e.flush(true)
+
+	return e.err
+}
+
+func (e *encryptWriter) flush(final bool) {
+	if e.err != nil {
+		return
+	}
+
+	e.out = e.out[:0]
+	if !e.header {
+		e.out = append(e.out, streamMagic...)
+		e.out = append(e.out, streamVersion)
+		e.out = append(e.out, e.nonce.prefix[:]...)
+		e.header = true
+	}
+	e.out = secretbox.Seal(e.out, e.buf, e.nonce.next(final), &e.key)
+	e.buf = e.buf[:0]
+
+	_, e.err = e.w.Write(e.out)
+}
+
+type decryptReader struct {
+	r      *bufio.Reader
+	key    [32]byte
+	nonce  streamNonce
+	in     []byte
+	out    []byte
+	plain  []byte // decrypted data not yet returned, within out
+	header bool   // whether the header has been read
+	done   bool   // whether the final chunk has been read
+	err    error
+}
+
+// NewDecryptReader returns a reader that decrypts a stream written by
+// NewEncryptWriter with key. Read returns an error if the stream has been
+// altered, reordered or truncated, but may first return data from the chunks
+// before the problem, so callers should not act on the data until Read
+// returns io.EOF.
+func NewDecryptReader(r io.Reader, key []byte) io.Reader {
+	if len(key) != 32 {
+		panic("invalid key length")
+	}
+
+	d := &decryptReader{
+		r:   bufio.NewReaderSize(r, streamChunkSize+secretbox.Overhead),
+		in:  make([]byte, streamChunkSize+secretbox.Overhead),
+		out: make([]byte, 0, streamChunkSize),
+	}
+	copy(d.key[:], key)
+
+	return d
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.next()
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// next reads and decrypts the next chunk.
+func (d *decryptReader) next() error {
+	if !d.header {
+		var header [streamHeaderSize]byte
+		if _, err := io.ReadFull(d.r, header[:]); err != nil {
+			return errDecrypt
+		}
+		if !bytes.Equal(header[:len(streamMagic)], streamMagic) {
+			return errors.New("not an encrypted stream")
+		}
+		if header[3] != streamVersion {
+			return fmt.Errorf("unknown encrypted stream version %d", header[3])
+		}
+		copy(d.nonce.prefix[:], header[4:])
+		d.header = true
+	}
+
+	n, err := io.ReadFull(d.r, d.in)
+	switch err {
+	case nil:
+		// A full chunk is the last one if nothing follows it
+		if _, err := d.r.Peek(1); err == io.EOF {
+			d.done = true
+		} else if err != nil {
+			return err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		d.done = true
+	default:
+		return err
+	}
+
+	plain, ok := secretbox.Open(d.out[:0], d.in[:n], d.nonce.next(d.done), &d.key)
+	if !ok {
+		return errDecrypt
+	}
+	d.plain = plain
+
+	return nil
+}
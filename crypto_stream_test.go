@@ -0,0 +1,98 @@
+package mu
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encryptStream(t *testing.T, data, key []byte) []byte {
+	var buf bytes.Buffer
+	w := NewEncryptWriter(&buf, key)
+
+	// Write in uneven pieces to exercise chunk boundaries
+	for len(data) > 0 {
+		n := min(len(data), 10000)
+		_, err := w.Write(data[:n])
+		assert.NoError(t, err)
+		data = data[n:]
+	}
+	assert.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+func decryptStream(data, key []byte) ([]byte, error) {
+	return io.ReadAll(NewDecryptReader(bytes.NewReader(data), key))
+}
+
+func TestEncryptStream(t *testing.T) {
+	key := RandBytes(32)
+
+	for _, size := range []int{0, 1, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3 * streamChunkSize, 200000} {
+		plaintext := RandBytes(size)
+		ciphertext := encryptStream(t, plaintext, key)
+
+		decrypted, err := decryptStream(ciphertext, key)
+		assert.NoError(t, err, "size %d", size)
+		assert.Equal(t, len(plaintext), len(decrypted), "size %d", size)
+		assert.True(t, bytes.Equal(plaintext, decrypted), "size %d", size)
+	}
+
+	ciphertext := encryptStream(t, []byte("hello"), key)
+	_, err := decryptStream(ciphertext, RandBytes(32))
+	assert.Error(t, err)
+
+	w := NewEncryptWriter(io.Discard, key)
+	w.Close()
+	_, err = w.Write([]byte("late"))
+	assert.Error(t, err)
+}
+
+func TestEncryptStream_Tampering(t *testing.T) {
+	key := RandBytes(32)
+	plaintext := RandBytes(3*streamChunkSize + 100)
+	ciphertext := encryptStream(t, plaintext, key)
+
+	chunk := streamChunkSize + 16
+	chunks := func(data []byte) [][]byte {
+		var out [][]byte
+		for i := streamHeaderSize; i < len(data); i += chunk {
+			out = append(out, data[i:min(i+chunk, len(data))])
+		}
+		return out
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(append([][]byte{ciphertext[:streamHeaderSize]}, parts...), nil)
+	}
+	c := chunks(ciphertext)
+	assert.Len(t, c, 4)
+
+	tests := map[string][]byte{
+		"reordered":         join(c[1], c[0], c[2], c[3]),
+		"truncated":         join(c[0], c[1], c[2]),
+		"truncated mid":     ciphertext[:len(ciphertext)-10],
+		"dropped chunk":     join(c[0], c[2], c[3]),
+		"duplicated chunk":  join(c[0], c[0], c[1], c[2], c[3]),
+		"header only":       ciphertext[:streamHeaderSize],
+		"empty":             nil,
+		"appended":          append(join(c...), 0),
+		"other stream":      join(c[0], chunks(encryptStream(t, plaintext, key))[1], c[2], c[3]),
+		"not a stream":      Encrypt(plaintext, key),
+		"flipped":           flipByte(ciphertext, streamHeaderSize+chunk+5),
+		"flipped in header": flipByte(ciphertext, 5),
+	}
+
+	for name, data := range tests {
+		_, err := decryptStream(data, key)
+		assert.Error(t, err, name)
+	}
+}
+
+func flipByte(data []byte, i int) []byte {
+	out := append([]byte{}, data...)
+	out[i] ^= 1
+	return out
+}
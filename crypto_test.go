@@ -1,9 +1,12 @@
 package mu
 
 import (
+	"encoding/binary"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/secretbox"
 )
 
 func init() {
@@ -85,3 +88,146 @@ func TestRandString(t *testing.T) {
 	assert.NotEqual(t, s1, s2)
 	assert.Len(t, s1, 20)
 }
+
+func TestEnvelope(t *testing.T) {
+	key := RandBytes(32)
+	plaintext := []byte("Attack at dawn!!!")
+
+	ciphertext := EncryptWithKeyID(plaintext, key, "2024-01")
+	env, err := ParseEnvelope(ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(1), env.Version)
+	assert.Equal(t, AlgSecretbox, env.Algorithm)
+	assert.Equal(t, "2024-01", env.KeyID)
+
+	decrypted, err := Decrypt(ciphertext, key)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	// The header is authenticated
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(envelopeMagic)+3] = 'X'
+	_, err = Decrypt(tampered, key)
+	assert.Error(t, err)
+
+	tampered = append([]byte{}, ciphertext...)
+	tampered[3] = 2
+	_, err = ParseEnvelope(tampered)
+	assert.EqualError(t, err, "unsupported envelope version 2")
+	_, err = Decrypt(tampered, key)
+	assert.EqualError(t, err, "unsupported envelope version 2")
+
+	tampered = append([]byte{}, ciphertext...)
+	tampered[4] = 99
+	_, err = ParseEnvelope(tampered)
+	assert.Error(t, err)
+	_, err = Decrypt(tampered, key)
+	assert.Error(t, err)
+
+	_, err = Decrypt(ciphertext[:10], key)
+	assert.Error(t, err)
+	_, err = Decrypt(nil, key)
+	assert.Error(t, err)
+}
+
+func TestDecryptVersion0(t *testing.T) {
+	key := RandBytes(32)
+	plaintext := []byte("Attack at dawn!!!")
+
+	// The format Encrypt produced before envelopes
+	var secretKey [32]byte
+	var nonce [24]byte
+	copy(secretKey[:], key)
+	copy(nonce[:], RandBytes(24))
+	legacy := secretbox.Seal(nonce[:], plaintext, &nonce, &secretKey)
+
+	env, err := ParseEnvelope(legacy)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0), env.Version)
+	assert.Equal(t, "", env.KeyID)
+
+	decrypted, err := Decrypt(legacy, key)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	// Even when the random nonce happens to look like an envelope header
+	copy(nonce[:], append(append([]byte{}, envelopeMagic...), envelopeVersion, 77, 0))
+	legacy = secretbox.Seal(nonce[:], plaintext, &nonce, &secretKey)
+	decrypted, err = Decrypt(legacy, key)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+}
+
+func TestEncryptWithPassword(t *testing.T) {
+	plaintext := []byte("Attack at dawn!!!")
+
+	ciphertext := EncryptWithPassword(plaintext, "hunter2")
+	decrypted, err := DecryptWithPassword(ciphertext, "hunter2")
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	_, err = DecryptWithPassword(ciphertext, "hunter3")
+	assert.Error(t, err)
+
+	// Decryption uses the stored parameters, not the current defaults
+	orig := DefaultArgon2Params
+	DefaultArgon2Params.Time++
+	DefaultArgon2Params.Memory *= 2
+	decrypted, err = DecryptWithPassword(ciphertext, "hunter2")
+	DefaultArgon2Params = orig
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	params := DefaultArgon2Params
+	params.Time = 1
+	ciphertext = EncryptWithPassword(plaintext, "hunter2", params)
+	decrypted, err = DecryptWithPassword(ciphertext, "hunter2")
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	// Altered parameters or salt change the key
+	for _, i := range []int{7, 20} {
+		ciphertext[i]++
+		_, err = DecryptWithPassword(ciphertext, "hunter2")
+		assert.Error(t, err)
+		ciphertext[i]--
+	}
+
+	// Parameters beyond the limits are rejected before deriving a key
+	for _, field := range []struct{ offset, size int }{{4, 4}, {8, 4}, {12, 1}} {
+		tampered := append([]byte{}, ciphertext...)
+		for i := 0; i < field.size; i++ {
+			tampered[field.offset+i] = 0xff
+		}
+		_, err = DecryptWithPassword(tampered, "hunter2")
+		assert.EqualError(t, err, "invalid Argon2 parameters")
+	}
+
+	params.KeyLen = 16
+	assert.Panics(t, func() { EncryptWithPassword(plaintext, "hunter2", params) })
+	params.KeyLen = 32
+	params.Memory = MaxArgon2Params.Memory + 1
+	assert.Panics(t, func() { EncryptWithPassword(plaintext, "hunter2", params) })
+
+	// Data just over the cost limit is rejected without deriving a key
+	tampered := append([]byte{}, ciphertext...)
+	binary.BigEndian.PutUint32(tampered[4:], MaxArgon2Params.Time+1)
+	start := time.Now()
+	_, err = DecryptWithPassword(tampered, "hunter2")
+	assert.EqualError(t, err, "invalid Argon2 parameters")
+	assert.True(t, time.Since(start) < 20*time.Millisecond)
+
+	// Callers can set their own limits
+	strict := DefaultArgon2Params
+	strict.Time = 1
+	_, err = DecryptWithPassword(EncryptWithPassword(plaintext, "hunter2"), "hunter2", strict)
+	assert.EqualError(t, err, "invalid Argon2 parameters")
+	decrypted, err = DecryptWithPassword(ciphertext, "hunter2", strict)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	_, err = DecryptWithPassword(ciphertext[:10], "hunter2")
+	assert.Error(t, err)
+	_, err = DecryptWithPassword(Encrypt(plaintext, RandBytes(32)), "hunter2")
+	assert.Error(t, err)
+}
@@ -0,0 +1,239 @@
+package mu
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CachedResponse is an HTTP response stored by CacheHandler.
+type CachedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// CachingHandler is the http.Handler returned by CacheHandler.
+type CachingHandler struct {
+	next            http.Handler
+	cache           *Cache[string, *CachedResponse]
+	vary            []string
+	shareAuthorized bool
+}
+
+// CacheHandler wraps next so that successful GET and HEAD responses are stored
+// in cache and replayed for later requests with the same method and URL, and
+// the same values of any vary headers.
+//
+// Requests and responses with "Cache-Control: no-store" bypass the cache, and
+// a response's max-age, if present, overrides the cache's TTL. Since cached
+// responses are shared between clients, responses marked private, setting
+// cookies or with a Vary header naming headers other than vary are never
+// stored, and requests with an Authorization header bypass
+// the cache unless ShareAuthorized is set. Every cached response carries an
+// ETag (one is derived from the body if next doesn't set one), and requests
+// whose If-None-Match matches it get a 304 Not Modified.
+func CacheHandler(next http.Handler, cache *Cache[string, *CachedResponse], vary ...string) *CachingHandler {
+	return &CachingHandler{
+		next:  next,
+		cache: cache,
+		vary:  vary,
+	}
+}
+
+// ShareAuthorized lets requests with an Authorization header use the cache,
+// for handlers whose responses don't depend on who is asking. Otherwise
+// include "Authorization" in the vary headers so each caller gets their own
+// entries.
+func (h *CachingHandler) ShareAuthorized(share bool) *CachingHandler {
+	h.shareAuthorized = share
+	return h
+}
+
+func (h *CachingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+		hasCacheDirective(r.Header, "no-store") ||
+		(r.Header.Get("Authorization") != "" && !h.shareAuthorized) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	key := httpCacheKey(r, h.vary)
+	if resp, ok := h.cache.Get(key); ok {
+		w.Header().Set("X-Cache", "HIT")
+		writeCachedResponse(w, r, resp)
+		return
+	}
+
+	rec := &responseRecorder{header: make(http.Header)}
+	h.next.ServeHTTP(rec, r)
+
+	resp := &CachedResponse{
+		Status: rec.status(),
+		Header: rec.header,
+		Body:   rec.body.Bytes(),
+	}
+
+	if h.storable(resp) {
+		if resp.Header.Get("ETag") == "" {
+			sum := sha256.Sum256(resp.Body)
+			resp.Header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		}
+
+		if maxAge, ok := cacheMaxAge(resp.Header); ok {
+			if maxAge > 0 {
+				h.cache.AddWithTTL(key, resp, maxAge)
+			}
+		} else {
+			h.cache.Add(key, resp)
+		}
+	}
+
+	w.Header().Set("X-Cache", "MISS")
+	writeCachedResponse(w, r, resp)
+}
+
+// storable reports whether a response may be shared with other clients. A
+// response that varies on a header the cache key doesn't include is not.
+func (h *CachingHandler) storable(resp *CachedResponse) bool {
+	if resp.Status != http.StatusOK || resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, d := range cacheDirectives(resp.Header) {
+		if d == "no-store" || d == "private" || strings.HasPrefix(d, "private=") {
+			return false
+		}
+	}
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if name == "*" || !h.varies(name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (h *CachingHandler) varies(name string) bool {
+	for _, v := range h.vary {
+		if http.CanonicalHeaderKey(v) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func httpCacheKey(r *http.Request, vary []string) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	b.WriteString(r.URL.String())
+	for _, name := range vary {
+		b.WriteByte('\n')
+		b.WriteString(http.CanonicalHeaderKey(name))
+		b.WriteByte(':')
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, resp *CachedResponse) {
+	header := w.Header()
+	for k, v := range resp.Header {
+		header[k] = append([]string(nil), v...)
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag != "" && resp.Status == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(resp.Status)
+	if r.Method != http.MethodHead {
+		w.Write(resp.Body)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag,
+// using weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheDirectives returns the lower-cased Cache-Control directives in header.
+func cacheDirectives(header http.Header) []string {
+	var directives []string
+	for _, value := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(value, ",") {
+			directives = append(directives, strings.ToLower(strings.TrimSpace(d)))
+		}
+	}
+	return directives
+}
+
+func hasCacheDirective(header http.Header, directive string) bool {
+	return StrListContains(cacheDirectives(header), directive)
+}
+
+func cacheMaxAge(header http.Header) (time.Duration, bool) {
+	for _, d := range cacheDirectives(header) {
+		if v, ok := strings.CutPrefix(d, "max-age="); ok {
+			secs, err := strconv.Atoi(strings.Trim(v, `"`))
+			if err != nil || secs < 0 {
+				return 0, true
+			}
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// responseRecorder buffers a response so it can be cached before being sent.
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
@@ -0,0 +1,271 @@
+package mu
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheHandler(t *testing.T) {
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "hello %s", r.URL.Query().Get("name"))
+	})
+	handler := CacheHandler(next, NewCache[string, *CachedResponse]())
+
+	get := func(url string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/greet?name=bob")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "hello bob", rec.Body.String())
+	assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	rec = get("/greet?name=bob")
+	assert.Equal(t, "hello bob", rec.Body.String())
+	assert.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "HIT", rec.Header().Get("X-Cache"))
+	assert.Equal(t, etag, rec.Header().Get("ETag"))
+	assert.Equal(t, 1, calls)
+
+	// Different URLs are cached separately
+	rec = get("/greet?name=alice")
+	assert.Equal(t, "hello alice", rec.Body.String())
+	assert.Equal(t, 2, calls)
+
+	// Revalidation
+	rec = get("/greet?name=bob", "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	rec = get("/greet?name=bob", "If-None-Match", `"other", W/`+etag)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	rec = get("/greet?name=bob", "If-None-Match", `"other"`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// no-store requests bypass the cache
+	rec = get("/greet?name=bob", "Cache-Control", "no-store")
+	assert.Equal(t, "hello bob", rec.Body.String())
+	assert.Equal(t, 3, calls)
+	assert.Empty(t, rec.Header().Get("X-Cache"))
+
+	// Other methods are never cached
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/greet?name=bob", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.Equal(t, 5, calls)
+}
+
+func TestCacheHandler_Vary(t *testing.T) {
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprint(w, r.Header.Get("Accept-Language"))
+	})
+	handler := CacheHandler(next, NewCache[string, *CachedResponse](), "Accept-Language")
+
+	for _, lang := range []string{"en", "fr", "en", "fr"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Language", lang)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, lang, rec.Body.String())
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestCacheHandler_ResponseDirectives(t *testing.T) {
+	clock := &Time{}
+	cache := NewCache[string, *CachedResponse]().Clock(clock).TTL(time.Hour)
+	calls := map[string]int{}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+		switch r.URL.Path {
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/max-age":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/max-age-zero":
+			w.Header().Set("Cache-Control", "max-age=0")
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/etag":
+			w.Header().Set("ETag", `"v1"`)
+		}
+		fmt.Fprint(w, "body")
+	})
+	handler := CacheHandler(next, cache)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	for _, path := range []string{"/no-store", "/max-age", "/max-age-zero", "/error", "/etag"} {
+		get(path)
+		get(path)
+	}
+	assert.Equal(t, map[string]int{
+		"/no-store":     2,
+		"/max-age":      1,
+		"/max-age-zero": 2,
+		"/error":        2,
+		"/etag":         1,
+	}, calls)
+
+	assert.Equal(t, `"v1"`, get("/etag").Header().Get("ETag"), "Existing ETags should be kept")
+
+	// max-age overrides the cache TTL
+	clock.Advance(2 * time.Minute)
+	get("/max-age")
+	get("/etag")
+	assert.Equal(t, 2, calls["/max-age"])
+	assert.Equal(t, 1, calls["/etag"])
+}
+
+func TestCacheHandler_Server(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(CacheHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprint(w, "ok")
+	}), NewCache[string, *CachedResponse]()))
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(server.URL + "/path")
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestCacheHandler_Private(t *testing.T) {
+	calls := map[string]int{}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+		user := r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/private-field":
+			w.Header().Set("Cache-Control", `private="X-User"`)
+		case "/cookie":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: user})
+		}
+		fmt.Fprint(w, "hello "+user)
+	})
+	handler := CacheHandler(next, NewCache[string, *CachedResponse]())
+
+	get := func(path, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if user != "" {
+			req.Header.Set("Authorization", user)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("private responses", func(t *testing.T) {
+		for _, path := range []string{"/private", "/private-field"} {
+			get(path, "")
+			get(path, "")
+			assert.Equal(t, 2, calls[path], path)
+		}
+	})
+
+	t.Run("cookies", func(t *testing.T) {
+		get("/cookie", "")
+		rec := get("/cookie", "")
+		assert.Equal(t, 2, calls["/cookie"])
+		assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+	})
+
+	t.Run("authorized requests", func(t *testing.T) {
+		rec := get("/public", "alice")
+		assert.Equal(t, "hello alice", rec.Body.String())
+		assert.Empty(t, rec.Header().Get("X-Cache"))
+
+		rec = get("/public", "bob")
+		assert.Equal(t, "hello bob", rec.Body.String(), "Responses must not leak between users")
+		assert.Equal(t, 2, calls["/public"])
+
+		// Unauthorized requests are still cached, and don't see authorized ones
+		assert.Equal(t, "hello ", get("/public", "").Body.String())
+		assert.Equal(t, "HIT", get("/public", "").Header().Get("X-Cache"))
+
+		shared := CacheHandler(next, NewCache[string, *CachedResponse]()).ShareAuthorized(true)
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/shared", nil)
+			req.Header.Set("Authorization", "alice")
+			shared.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		assert.Equal(t, 1, calls["/shared"])
+	})
+}
+
+func TestCacheHandler_ResponseVary(t *testing.T) {
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/star":
+			w.Header().Set("Vary", "*")
+		case "/lang":
+			w.Header().Set("Vary", "accept-language")
+		default:
+			w.Header().Set("Vary", "Accept-Encoding")
+		}
+		if r.Header.Get("Accept-Encoding") == "gzip" {
+			fmt.Fprint(w, "GZIPPED")
+			return
+		}
+		fmt.Fprint(w, "plain")
+	})
+
+	get := func(handler http.Handler, path, encoding string) string {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	// The key doesn't include Accept-Encoding, so nothing may be stored
+	handler := CacheHandler(next, NewCache[string, *CachedResponse](), "Accept-Language")
+	assert.Equal(t, "GZIPPED", get(handler, "/", "gzip"))
+	assert.Equal(t, "plain", get(handler, "/", ""))
+	get(handler, "/star", "")
+	get(handler, "/star", "")
+	assert.Equal(t, 4, calls)
+
+	// Headers in the key may be named in any case
+	get(handler, "/lang", "")
+	get(handler, "/lang", "")
+	assert.Equal(t, 5, calls)
+
+	// Once Accept-Encoding is part of the key, the response can be stored
+	calls = 0
+	handler = CacheHandler(next, NewCache[string, *CachedResponse](), "Accept-Encoding")
+	assert.Equal(t, "GZIPPED", get(handler, "/", "gzip"))
+	assert.Equal(t, "plain", get(handler, "/", ""))
+	assert.Equal(t, "GZIPPED", get(handler, "/", "gzip"))
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,34 @@
+package mu
+
+import "context"
+
+// Memoize returns a function that caches the results of fn. Results are stored
+// in cache if one is given, so its TTL, capacity and other settings apply, or
+// else in a new default Cache. Concurrent calls with the same argument share a
+// single call to fn, and errors are not cached unless the cache has a
+// NegativeTTL.
+func Memoize[K comparable, V any](fn func(K) (V, error), cache ...*Cache[K, V]) func(K) (V, error) {
+	memo := MemoizeContext(func(_ context.Context, key K) (V, error) {
+		return fn(key)
+	}, cache...)
+
+	return func(key K) (V, error) {
+		return memo(context.Background(), key)
+	}
+}
+
+// MemoizeContext is like Memoize for functions that take a context. A call
+// returns early with the context's error if it is cancelled while waiting for
+// a result.
+func MemoizeContext[K comparable, V any](fn func(context.Context, K) (V, error), cache ...*Cache[K, V]) func(context.Context, K) (V, error) {
+	c := NewCache[K, V]()
+	if len(cache) > 0 {
+		c = cache[0]
+	}
+
+	return func(ctx context.Context, key K) (V, error) {
+		return c.GetOrLoad(ctx, key, func(ctx context.Context) (V, error) {
+			return fn(ctx, key)
+		})
+	}
+}
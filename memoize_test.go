@@ -0,0 +1,93 @@
+package mu
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoize(t *testing.T) {
+	calls := map[int]int{}
+	square := Memoize(func(n int) (int, error) {
+		calls[n]++
+		if n < 0 {
+			return 0, errors.New("negative")
+		}
+		return n * n, nil
+	})
+
+	for i := 0; i < 3; i++ {
+		val, err := square(4)
+		assert.NoError(t, err)
+		assert.Equal(t, 16, val)
+	}
+	assert.Equal(t, 1, calls[4])
+
+	_, err := square(-1)
+	assert.Error(t, err)
+	_, err = square(-1)
+	assert.Error(t, err)
+	assert.Equal(t, 2, calls[-1], "Errors should not be cached")
+}
+
+func TestMemoize_Cache(t *testing.T) {
+	clock := &Time{}
+	calls := 0
+	cache := NewCache[string, int]().Clock(clock).TTL(time.Minute)
+	length := Memoize(func(s string) (int, error) {
+		calls++
+		return len(s), nil
+	}, cache)
+
+	length("abc")
+	length("abc")
+	assert.Equal(t, 1, calls)
+
+	val, ok := cache.Get("abc")
+	assert.True(t, ok, "Results should be stored in the given cache")
+	assert.Equal(t, 3, val)
+
+	clock.Advance(2 * time.Minute)
+	length("abc")
+	assert.Equal(t, 2, calls, "The cache's TTL should apply")
+}
+
+func TestMemoizeContext(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	slow := MemoizeContext(func(ctx context.Context, n int) (int, error) {
+		calls.Add(1)
+		<-release
+		return n, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := slow(context.Background(), 7)
+			assert.NoError(t, err)
+			assert.Equal(t, 7, val)
+		}()
+	}
+
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := slow(ctx, 7)
+	assert.Equal(t, context.Canceled, err)
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load(), "Concurrent calls should be coalesced")
+}